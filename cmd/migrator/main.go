@@ -0,0 +1,47 @@
+package main
+
+import (
+	"avito-internship/internal/config"
+	"avito-internship/internal/storage/postgres/migrations"
+	"context"
+	"database/sql"
+	"flag"
+	"log"
+
+	_ "github.com/lib/pq"
+)
+
+func main() {
+	direction := flag.String("direction", "up", "migration direction: up or down")
+	steps := flag.Int("steps", 1, "number of migrations to roll back with -direction=down")
+	flag.Parse()
+
+	cfg := config.MustConfigLoad()
+
+	db, err := sql.Open("postgres", cfg.PostgresPath)
+	if err != nil {
+		log.Fatalf("Cannot open database: %s", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	switch *direction {
+	case "up":
+		err = migrations.Up(ctx, db)
+	case "down":
+		err = migrations.Down(ctx, db, *steps)
+	default:
+		log.Fatalf("Unknown direction: %s", *direction)
+	}
+	if err != nil {
+		log.Fatalf("Migration failed: %s", err)
+	}
+
+	version, err := migrations.Version(ctx, db)
+	if err != nil {
+		log.Fatalf("Cannot get schema version: %s", err)
+	}
+
+	log.Printf("Schema is at version %d", version)
+}
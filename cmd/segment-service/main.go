@@ -2,23 +2,62 @@ package main
 
 import (
 	"avito-internship/internal/config"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/auth"
+	"avito-internship/internal/lib/idempotency"
+	"avito-internship/internal/lib/jobs"
 	"avito-internship/internal/lib/logger/handlers/slogpretty"
 	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/lib/metrics"
+	"avito-internship/internal/lib/ratelimit"
+	"avito-internship/internal/lib/readiness"
+	"avito-internship/internal/lib/tracing"
+	"avito-internship/internal/sweeper"
+	"context"
 	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"avito-internship/internal/storage"
+	"avito-internship/internal/storage/memory"
 	"avito-internship/internal/storage/postgres"
+	"errors"
+	"fmt"
 	"os"
 
+	"avito-internship/internal/http-server/handlers/apikeys"
+	"avito-internship/internal/http-server/handlers/docs"
+	"avito-internship/internal/http-server/handlers/health"
+	jobstatus "avito-internship/internal/http-server/handlers/jobs"
+	"avito-internship/internal/http-server/handlers/reports/audit"
+	"avito-internship/internal/http-server/handlers/reports/history"
 	"avito-internship/internal/http-server/handlers/segments/del"
+	"avito-internship/internal/http-server/handlers/segments/get"
+	"avito-internship/internal/http-server/handlers/segments/list"
+	"avito-internship/internal/http-server/handlers/segments/members"
+	"avito-internship/internal/http-server/handlers/segments/rename"
+	"avito-internship/internal/http-server/handlers/segments/restore"
 	"avito-internship/internal/http-server/handlers/segments/save"
+	"avito-internship/internal/http-server/handlers/segments/update"
 	delsegments "avito-internship/internal/http-server/handlers/users/del_segments"
 	getactiveseg "avito-internship/internal/http-server/handlers/users/get-active-seg"
+	importusers "avito-internship/internal/http-server/handlers/users/import_users"
 	"avito-internship/internal/http-server/handlers/users/save/saveuser"
 	save_seg_user "avito-internship/internal/http-server/handlers/users/save_seg_user"
+	updatesegments "avito-internship/internal/http-server/handlers/users/update_segments"
+	mwAuth "avito-internship/internal/http-server/middleware/auth"
+	mwIdempotency "avito-internship/internal/http-server/middleware/idempotency"
 	mwLogger "avito-internship/internal/http-server/middleware/logger"
+	mwMetrics "avito-internship/internal/http-server/middleware/metrics"
+	mwRateLimit "avito-internship/internal/http-server/middleware/ratelimit"
+	mwTracing "avito-internship/internal/http-server/middleware/tracing"
 
-	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/exp/slog"
 )
 
@@ -27,6 +66,17 @@ const (
 	envDev   = "dev"
 )
 
+const (
+	storagePostgres = "postgres"
+	storageMemory   = "memory"
+)
+
+const (
+	rateLimitNone     = "none"
+	rateLimitMemory   = "memory"
+	rateLimitPostgres = "postgres"
+)
+
 func main() {
 	cfg := config.MustConfigLoad()
 
@@ -35,43 +85,454 @@ func main() {
 	log.Info("Starting segment service", slog.String("env", cfg.Env))
 	log.Debug("Debug messages are enabled")
 
-	storage, err := postgres.New(cfg.PostgresPath)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		log.Error("failed to init tracing", slogger.Err(err))
+		os.Exit(1)
+	}
+
+	store, err := setupStorage(cfg)
 	if err != nil {
 		log.Error("failed to init storage", slogger.Err(err))
 		os.Exit(1)
 	}
 
-	router := chi.NewRouter()
+	registry, err := setupMetrics(store, cfg.Health.CheckTimeout)
+	if err != nil {
+		log.Error("failed to init metrics", slogger.Err(err))
+		os.Exit(1)
+	}
 
-	router.Use(middleware.RequestID)
-	router.Use(middleware.Logger)
-	router.Use(mwLogger.New(log))
-	router.Use(middleware.Recoverer)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var ready, sweeperRunning readiness.Flag
+
+	// Background workers run until shutdown and are waited for before storage is closed.
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		sweeperRunning.SetReady(true)
+		defer sweeperRunning.SetReady(false)
+		sweeper.Run(workersCtx, log, store, cfg.Sweeper.Interval, cfg.Segments.Retention)
+	}()
+
+	idempotencyStore := setupIdempotencyStore(store)
 
-	// Create and delete segments
-	router.Post("/segment", save.New(log, storage))
-	router.Delete("/segment/{id}", del.DelSeg(log, storage))
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		idempotency.RunCleanup(workersCtx, log, idempotencyStore, cfg.Sweeper.Interval)
+	}()
+
+	limiter, err := setupRateLimiter(store, cfg.RateLimit.Backend)
+	if err != nil {
+		log.Error("failed to init rate limiting", slogger.Err(err))
+		os.Exit(1)
+	}
+	policy := setupRateLimitPolicy(cfg.RateLimit)
+
+	// Buckets kept in the database are not forgotten by the limiter itself.
+	if sweeper, ok := limiter.(ratelimit.Sweeper); ok {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			ratelimit.RunCleanup(workersCtx, log, sweeper, policy.Refill(), cfg.Sweeper.Interval)
+		}()
+	}
+
+	queue := jobs.NewQueue(cfg.Jobs.QueueSize, cfg.Jobs.TTL)
+
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		queue.Run(workersCtx, log, cfg.Jobs.Workers)
+	}()
+
+	guards, err := setupGuards(log, store, cfg, limiter, policy)
+	if err != nil {
+		log.Error("failed to init auth", slogger.Err(err))
+		os.Exit(1)
+	}
 
-	router.Post("/users", saveuser.New(log, storage))
+	// A request holds its idempotency key no longer than the server lets it run.
+	idempotent := mwIdempotency.New(log, idempotencyStore, cfg.Idempotency.TTL, cfg.HTTPServer.Timeout, cfg.Idempotency.MaxBodySize)
 
-	// Get active users segments, save segments to user, delete segments from user
-	router.Get("/users/{id}/segments", getactiveseg.GetActiveSegmentsForUser(log, storage))
-	router.Post("/users/{id}/segments", save_seg_user.AddUserToSegments(log, storage))
-	router.Delete("/segment/{segmentName}", delsegments.DelSeg(log, storage))
+	router := setupRouter(log, store, cfg.Segments, queue, health.Ready(log, &ready, cfg.Health.CheckTimeout, setupChecks(store, &sweeperRunning)...), idempotent, guards...)
 
 	srv := &http.Server{
-		Addr:         cfg.Address,
+		Addr:         cfg.HTTPServer.Address,
 		Handler:      router,
 		ReadTimeout:  cfg.HTTPServer.Timeout,
 		WriteTimeout: cfg.HTTPServer.Timeout,
 		IdleTimeout:  cfg.HTTPServer.IdleTimeout,
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
-		log.Error("failed to start server")
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed to start server", slogger.Err(err))
+			stop()
+		}
+	}()
+
+	uploadSrv := newUploadServer(cfg, setupUploadRouter(log, store, queue, cfg.Import, guards...))
+
+	go func() {
+		if err := uploadSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed to start upload server", slogger.Err(err))
+			stop()
+		}
+	}()
+
+	adminSrv := &http.Server{
+		Addr:        cfg.AdminServer.Address,
+		Handler:     setupAdminRouter(registry),
+		IdleTimeout: cfg.HTTPServer.IdleTimeout,
+	}
+
+	go func() {
+		if err := adminSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("failed to start admin server", slogger.Err(err))
+			stop()
+		}
+	}()
+
+	ready.SetReady(true)
+	log.Info("server started",
+		slog.String("address", cfg.HTTPServer.Address),
+		slog.String("upload_address", cfg.UploadServer.Address),
+		slog.String("admin_address", cfg.AdminServer.Address),
+	)
+
+	<-ctx.Done()
+
+	ready.SetReady(false)
+	log.Info("shutting down server", slog.String("grace_period", cfg.HTTPServer.ShutdownTimeout.String()))
+
+	// Give load balancers time to notice the service is not ready.
+	time.Sleep(cfg.HTTPServer.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.HTTPServer.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to drain in-flight requests", slogger.Err(err))
+	}
+
+	if err := uploadSrv.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to drain in-flight uploads", slogger.Err(err))
+	}
+
+	// The admin server stays up while draining so metrics can still be scraped.
+	if err := adminSrv.Shutdown(shutdownCtx); err != nil {
+		log.Error("failed to stop admin server", slogger.Err(err))
+	}
+
+	stopWorkers()
+
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+
+	select {
+	case <-workersDone:
+	case <-shutdownCtx.Done():
+		log.Error("background workers did not stop in time")
 	}
 
-	log.Error("server stopped")
+	if err := store.Close(); err != nil {
+		log.Error("failed to close storage", slogger.Err(err))
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Error("failed to flush traces", slogger.Err(err))
+	}
+
+	log.Info("server stopped")
+}
+
+// newRouter returns a router with the middlewares shared by the API and
+// the upload listeners.
+func newRouter(log *slog.Logger) *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Use(middleware.RequestID)
+	router.Use(mwTracing.New())
+	router.Use(middleware.Logger)
+	router.Use(mwLogger.New(log))
+	router.Use(mwMetrics.New())
+	router.Use(middleware.Recoverer)
+
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		resp.WriteProblem(w, r, resp.NewProblem(http.StatusNotFound, resp.CodeRouteNotFound, "route not found"))
+	})
+	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		resp.WriteProblem(w, r, resp.NewProblem(http.StatusMethodNotAllowed, resp.CodeMethodNotAllowed, "method not allowed"))
+	})
+
+	return router
+}
+
+func setupRouter(
+	log *slog.Logger,
+	store storage.Store,
+	segmentsCfg config.Segments,
+	queue *jobs.Queue,
+	readyz http.HandlerFunc,
+	idempotent func(next http.Handler) http.Handler,
+	guards ...func(next http.Handler) http.Handler,
+) *chi.Mux {
+	router := newRouter(log)
+
+	// Liveness and readiness probes
+	router.Get("/healthz", health.Live())
+	router.Get("/readyz", readyz)
+
+	// API documentation
+	router.Get("/openapi.json", docs.Spec())
+	router.Get("/docs", docs.UI())
+
+	// Everything else is guarded by authentication and rate limiting, and
+	// requires an API key or a user role with the scope of the route.
+	router.Group(func(r chi.Router) {
+		r.Use(guards...)
+
+		// Create and delete segments
+		r.With(mwAuth.Require(auth.ScopeSegmentsWrite), idempotent).Post("/segment", save.New(log, store))
+		r.With(mwAuth.Require(auth.ScopeSegmentsWrite)).Delete("/segment/{id}", del.DelSeg(log, store))
+		r.With(mwAuth.Require(auth.ScopeSegmentsRead)).Get("/segments", list.New(log, store))
+		r.With(mwAuth.Require(auth.ScopeSegmentsRead)).Get("/segments/{slug}", get.New(log, store))
+		r.With(mwAuth.Require(auth.ScopeSegmentsWrite)).Put("/segments/{slug}", update.New(log, store))
+		r.With(mwAuth.Require(auth.ScopeSegmentsWrite), idempotent).Post("/segments/{slug}/rename", rename.New(log, store, segmentsCfg.AliasTTL))
+		r.With(mwAuth.Require(auth.ScopeSegmentsWrite), idempotent).Post("/segments/{slug}/restore", restore.New(log, store, segmentsCfg.Retention))
+
+		r.With(mwAuth.Require(auth.ScopeUsersWrite), idempotent).Post("/users", saveuser.New(log, store))
+
+		// Track the progress of imports and other background jobs
+		r.With(mwAuth.Require(auth.ScopeUsersWrite)).Get("/jobs/{id}", jobstatus.Get(log, queue))
+
+		// Get active users segments, save segments to user, delete segments from user
+		r.With(mwAuth.Require(auth.ScopeSegmentsRead)).Get("/users/{id}/segments", getactiveseg.GetActiveSegmentsForUser(log, store))
+		r.With(mwAuth.Require(auth.ScopeUsersWrite), idempotent).Post("/users/{id}/segments", save_seg_user.AddUserToSegments(log, store))
+		r.With(mwAuth.Require(auth.ScopeUsersWrite), idempotent).Delete("/users/{id}/segments", delsegments.DelSeg(log, store))
+		r.With(mwAuth.Require(auth.ScopeUsersWrite), idempotent).Patch("/users/{id}/segments", updatesegments.Update(log, store))
+
+		// Monthly report of segment membership changes
+		r.With(mwAuth.Require(auth.ScopeReportsRead)).Get("/reports/history", history.New(log, store))
+		r.With(mwAuth.Require(auth.ScopeReportsRead)).Get("/reports/audit", audit.New(log, store))
+
+		// Issue, rotate and revoke API keys
+		r.Group(func(r chi.Router) {
+			r.Use(mwAuth.Require(auth.ScopeKeysAdmin))
+
+			r.Post("/api-keys", apikeys.Create(log, store))
+			r.Post("/api-keys/{id}/rotate", apikeys.Rotate(log, store))
+			r.Delete("/api-keys/{id}", apikeys.Revoke(log, store))
+		})
+	})
+
+	return router
+}
+
+// setupUploadRouter returns the router of the upload listener. Uploads are
+// guarded like the API routes but not buffered by the idempotency
+// middleware.
+func setupUploadRouter(
+	log *slog.Logger,
+	store storage.Store,
+	queue *jobs.Queue,
+	importCfg config.Import,
+	guards ...func(next http.Handler) http.Handler,
+) *chi.Mux {
+	router := newRouter(log)
+
+	router.Group(func(r chi.Router) {
+		r.Use(guards...)
+
+		// Import users and change segment members in bulk in the background
+		r.With(mwAuth.Require(auth.ScopeUsersWrite)).Post("/users:import", importusers.New(log, queue, store, importCfg.MaxSize, importCfg.BatchSize))
+		r.With(mwAuth.Require(auth.ScopeUsersWrite)).Post("/segments/{slug}/members:bulk", members.Bulk(log, store, queue, store, importCfg.MaxSize, importCfg.BatchSize))
+		// Jobs are reported on both listeners, so that the Location of a
+		// submitted job can be followed on the listener it was submitted to
+		r.With(mwAuth.Require(auth.ScopeUsersWrite)).Get("/jobs/{id}", jobstatus.Get(log, queue))
+	})
+
+	return router
+}
+
+// newUploadServer returns the server of the upload listener. Its timeout
+// is long enough to read uploads of up to Import.MaxSize, other requests
+// are served by the API listener with the shorter HTTPServer.Timeout.
+func newUploadServer(cfg *config.Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              cfg.UploadServer.Address,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.HTTPServer.Timeout,
+		ReadTimeout:       cfg.UploadServer.Timeout,
+		WriteTimeout:      cfg.UploadServer.Timeout,
+		IdleTimeout:       cfg.HTTPServer.IdleTimeout,
+	}
+}
+
+// setupGuards returns the middlewares of API routes: rate limiting by the
+// remote address, authentication by API keys and, if configured, user
+// JWTs, followed by rate limiting of the authenticated clients. Addresses
+// are limited before authentication so that attempts with invalid
+// credentials are limited too.
+func setupGuards(log *slog.Logger, store storage.Store, cfg *config.Config, limiter ratelimit.Limiter, policy ratelimit.Policy) ([]func(next http.Handler) http.Handler, error) {
+	authenticators := []mwAuth.Authenticator{mwAuth.APIKey(store, cfg.Auth.BootstrapKey)}
+
+	verifier, err := auth.NewJWTVerifier(auth.JWTOptions{
+		HMACSecretFile: cfg.Auth.JWT.HMACSecretFile,
+		PublicKeyFile:  cfg.Auth.JWT.PublicKeyFile,
+		JWKSFile:       cfg.Auth.JWT.JWKSFile,
+		Issuer:         cfg.Auth.JWT.Issuer,
+		Audience:       cfg.Auth.JWT.Audience,
+		RolesClaim:     cfg.Auth.JWT.RolesClaim,
+		RoleMapping:    cfg.Auth.JWT.RoleMapping,
+		Leeway:         cfg.Auth.JWT.Leeway,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if verifier != nil {
+		authenticators = append(authenticators, mwAuth.Bearer(verifier))
+	}
+
+	if limiter == nil {
+		return []func(next http.Handler) http.Handler{mwAuth.New(log, authenticators...)}, nil
+	}
+
+	return []func(next http.Handler) http.Handler{
+		mwRateLimit.ByAddress(log, limiter, policy),
+		mwAuth.New(log, authenticators...),
+		mwRateLimit.New(log, limiter, policy),
+	}, nil
+}
+
+// setupRateLimitPolicy maps the configured limits to the policy.
+func setupRateLimitPolicy(cfg config.RateLimit) ratelimit.Policy {
+	policy := ratelimit.Policy{
+		Address: ratelimit.Limit{Rate: cfg.Address.Rate, Burst: cfg.Address.Burst},
+		Default: ratelimit.Limit{Rate: cfg.Default.Rate, Burst: cfg.Default.Burst},
+		Routes:  make(map[string]ratelimit.Limit, len(cfg.Routes)),
+	}
+	for route, rule := range cfg.Routes {
+		policy.Routes[route] = ratelimit.Limit{Rate: rule.Rate, Burst: rule.Burst}
+	}
+
+	return policy
+}
+
+// setupIdempotencyStore keeps idempotency keys in the database shared by
+// instances if the storage supports it and in memory otherwise.
+func setupIdempotencyStore(store storage.Store) idempotency.Store {
+	if s, ok := store.(interface {
+		IdempotencyStore() idempotency.Store
+	}); ok {
+		return s.IdempotencyStore()
+	}
+
+	return idempotency.NewMemory()
+}
+
+func setupRateLimiter(store storage.Store, backend string) (ratelimit.Limiter, error) {
+	switch backend {
+	case rateLimitNone:
+		return nil, nil
+	case rateLimitMemory:
+		return ratelimit.NewMemory(), nil
+	case rateLimitPostgres:
+		s, ok := store.(interface {
+			RateLimiter() ratelimit.Limiter
+		})
+		if !ok {
+			return nil, errors.New("postgres rate limiting requires postgres storage")
+		}
+		return s.RateLimiter(), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %q", backend)
+	}
+}
+
+// setupAdminRouter returns the router of operational endpoints served on
+// the admin listener.
+func setupAdminRouter(registry *prometheus.Registry) *chi.Mux {
+	router := chi.NewRouter()
+
+	router.Use(middleware.Recoverer)
+
+	router.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	return router
+}
+
+// setupMetrics registers HTTP, storage and runtime metrics. Storage
+// statistics are queried on every scrape, bounded by timeout.
+func setupMetrics(store storage.Store, timeout time.Duration) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+
+	if err := metrics.Register(registry); err != nil {
+		return nil, err
+	}
+
+	if err := registry.Register(metrics.NewStorageCollector(store, timeout)); err != nil {
+		return nil, err
+	}
+
+	if c, ok := store.(interface {
+		Collector() prometheus.Collector
+	}); ok {
+		if err := registry.Register(c.Collector()); err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
+
+// setupChecks returns the dependencies /readyz reports on.
+func setupChecks(store storage.Store, sweeperRunning *readiness.Flag) []health.Check {
+	checks := []health.Check{
+		{Name: "storage", Check: store.Ping},
+	}
+
+	if m, ok := store.(interface {
+		CheckMigrations(ctx context.Context) error
+	}); ok {
+		checks = append(checks, health.Check{Name: "migrations", Check: m.CheckMigrations})
+	}
+
+	checks = append(checks, health.Check{Name: "sweeper", Check: func(context.Context) error {
+		if !sweeperRunning.Ready() {
+			return errors.New("sweeper is not running")
+		}
+		return nil
+	}})
+
+	return checks
+}
+
+func setupStorage(cfg *config.Config) (storage.Store, error) {
+	switch cfg.Storage {
+	case storagePostgres:
+		if cfg.PostgresPath == "" {
+			return nil, errors.New("postgres_path isn't set up")
+		}
+		return postgres.New(cfg.PostgresPath, postgres.Timeouts{
+			Default:    cfg.QueryTimeouts.Default,
+			Operations: cfg.QueryTimeouts.Operations,
+		})
+	case storageMemory:
+		return memory.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.Storage)
+	}
 }
 
 func setupLogger(env string) *slog.Logger {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"avito-internship/internal/config"
+	"avito-internship/internal/http-server/handlers/docs"
+	"avito-internship/internal/http-server/handlers/health"
+	mwAuth "avito-internship/internal/http-server/middleware/auth"
+	mwIdempotency "avito-internship/internal/http-server/middleware/idempotency"
+	"avito-internship/internal/lib/idempotency"
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/ratelimit"
+	"avito-internship/internal/lib/readiness"
+	"avito-internship/internal/storage/memory"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+// TestOpenAPICoversRoutes fails when a route is registered on the router
+// but not described in the OpenAPI document.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(docs.OpenAPI, &spec))
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New()
+	queue := jobs.NewQueue(1, time.Hour)
+	routers := []*chi.Mux{
+		setupRouter(log, store, config.Segments{AliasTTL: time.Hour, Retention: time.Hour},
+			queue, health.Ready(log, &readiness.Flag{}, time.Second),
+			mwIdempotency.New(log, idempotency.NewMemory(), time.Hour, time.Second, 1<<20)),
+		setupUploadRouter(log, store, queue, config.Import{MaxSize: 1 << 20, BatchSize: 100}),
+	}
+
+	for _, router := range routers {
+		err := chi.Walk(router, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+			operations, ok := spec.Paths[route]
+			if !ok {
+				t.Errorf("route %s is missing from the OpenAPI document", route)
+				return nil
+			}
+			if _, ok := operations[strings.ToLower(method)]; !ok {
+				t.Errorf("operation %s %s is missing from the OpenAPI document", method, route)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+	}
+}
+
+// TestGuardsLimitInvalidCredentials checks that requests with a new invalid
+// key each are limited by their address.
+func TestGuardsLimitInvalidCredentials(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New()
+	policy := ratelimit.Policy{
+		Address: ratelimit.Limit{Rate: 0.001, Burst: 2},
+		Default: ratelimit.Limit{Rate: 100, Burst: 100},
+	}
+
+	guards, err := setupGuards(log, store, &config.Config{}, ratelimit.NewMemory(), policy)
+	require.NoError(t, err)
+
+	router := setupRouter(log, store, config.Segments{AliasTTL: time.Hour, Retention: time.Hour},
+		jobs.NewQueue(1, time.Hour), health.Ready(log, &readiness.Flag{}, time.Second),
+		mwIdempotency.New(log, idempotency.NewMemory(), time.Hour, time.Second, 1<<20), guards...)
+
+	var codes []int
+	for _, key := range []string{"invalid-1", "invalid-2", "invalid-3"} {
+		req := httptest.NewRequest(http.MethodGet, "/segments", nil)
+		req.Header.Set(mwAuth.HeaderAPIKey, key)
+
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+	}
+
+	require.Equal(t, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}, codes)
+}
+
+// TestUploadServerReadsLargeBody checks that the upload listener reads an
+// upload which takes longer than the API timeout allows.
+func TestUploadServerReadsLargeBody(t *testing.T) {
+	cfg := &config.Config{
+		HTTPServer:   config.HTTPServer{Timeout: 100 * time.Millisecond, IdleTimeout: time.Minute},
+		UploadServer: config.UploadServer{Timeout: 10 * time.Second},
+		Import:       config.Import{MaxSize: 8 << 20, BatchSize: 100},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New()
+	guard := mwAuth.New(log, mwAuth.APIKey(store, "bootstrap-key"))
+	srv := newUploadServer(cfg, setupUploadRouter(log, store, jobs.NewQueue(1, time.Hour), cfg.Import, guard))
+
+	ts := httptest.NewUnstartedServer(srv.Handler)
+	ts.Config = srv
+	ts.Start()
+	defer ts.Close()
+
+	// 4 MiB are sent in parts over four times the API timeout.
+	body, w := io.Pipe()
+	go func() {
+		line := []byte(`{"userId": 1000, "segments": ["AVITO_VOICE_MESSAGES"]}` + "\n")
+		part := bytes.Repeat(line, (512<<10)/len(line)+1)
+		for i := 0; i < 8; i++ {
+			if _, err := w.Write(part); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		w.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/users:import", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-API-Key", "bootstrap-key")
+
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusAccepted, res.StatusCode)
+
+	// The job is reported on the upload listener as well.
+	req, err = http.NewRequest(http.MethodGet, ts.URL+res.Header.Get("Location"), nil)
+	require.NoError(t, err)
+	req.Header.Set("X-API-Key", "bootstrap-key")
+
+	job, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer job.Body.Close()
+
+	require.Equal(t, http.StatusOK, job.StatusCode)
+}
@@ -0,0 +1,323 @@
+// Package bulkmembers adds users to a segment or removes them from it in
+// bulk from lists of user ids.
+package bulkmembers
+
+import (
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/lines"
+	"avito-internship/internal/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Actions of a bulk change.
+const (
+	ActionAdd    = "add"
+	ActionRemove = "remove"
+)
+
+// Formats of the input.
+const (
+	// FormatText has a user id on every line, further CSV columns are
+	// ignored. A first line whose user id is not a number is a header.
+	FormatText = "text"
+	// FormatJSON is an object with the user ids in the user_ids array.
+	FormatJSON = "json"
+)
+
+// Counters of bulk jobs. Adding counts added and already present users,
+// removing counts removed and absent ones.
+const (
+	CounterProcessed      = "processed"
+	CounterAdded          = "added"
+	CounterAlreadyPresent = "already_present"
+	CounterCreated        = "created"
+	CounterRemoved        = "removed"
+	CounterAbsent         = "absent"
+	// CounterUnknown counts users which do not exist and were not created.
+	CounterUnknown = "unknown"
+	// CounterFailed counts invalid user ids.
+	CounterFailed = "failed"
+)
+
+// maxLineSize bounds a single line of text input.
+const maxLineSize = 64 * 1024
+
+var errUserIDRequired = errors.New("user id is required")
+
+type Store interface {
+	AddSegmentMembers(ctx context.Context, segmentID int64, users []int64, createMissing bool) (storage.MembersResult, error)
+	RemoveSegmentMembers(ctx context.Context, segmentID int64, users []int64) (storage.MembersResult, error)
+}
+
+// Change is a bulk change of the members of a segment.
+type Change struct {
+	SegmentID int64
+	Action    string
+	// CreateMissing creates users which do not exist when adding.
+	CreateMissing bool
+}
+
+// entry is a user id read from the input. line is the position of the id
+// in the user_ids array of JSON input.
+type entry struct {
+	line int
+	id   int64
+}
+
+// entryError is an invalid user id, the input is read on after it.
+type entryError struct {
+	line int
+	err  error
+}
+
+func (e *entryError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+type reader interface {
+	// read returns the next user id, an *entryError if it is invalid or
+	// io.EOF at the end of the input.
+	read() (entry, error)
+}
+
+// Apply reads user ids in format from r and applies the change to them in
+// batches of batchSize, each in its own transaction. Unknown and invalid
+// user ids are reported to progress, the others are still changed.
+//
+// It stops on the first read or storage error, batches applied before
+// are kept.
+func Apply(ctx context.Context, store Store, r io.Reader, format string, change Change, batchSize int, progress *jobs.Progress) error {
+	const op = "bulkmembers.Apply"
+
+	var rd reader
+	switch format {
+	case FormatText:
+		rd = newTextReader(r)
+	case FormatJSON:
+		rd = newJSONReader(r)
+	default:
+		return fmt.Errorf("%s: unknown format %q", op, format)
+	}
+
+	// Every counter of the action is reported, even if it stays zero.
+	for _, counter := range counters(change.Action) {
+		progress.Add(counter, 0)
+	}
+
+	batch := make([]entry, 0, batchSize)
+
+	for {
+		next, err := rd.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var entryErr *entryError
+		if errors.As(err, &entryErr) {
+			progress.Add(CounterProcessed, 1)
+			progress.Add(CounterFailed, 1)
+			progress.Fail(entryErr.line, entryErr.err)
+
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: failed to read input: %w", op, err)
+		}
+
+		batch = append(batch, next)
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err := applyBatch(ctx, store, change, batch, progress); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		batch = batch[:0]
+	}
+
+	if err := applyBatch(ctx, store, change, batch, progress); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func counters(action string) []string {
+	if action == ActionRemove {
+		return []string{CounterProcessed, CounterRemoved, CounterAbsent, CounterUnknown, CounterFailed}
+	}
+
+	return []string{CounterProcessed, CounterAdded, CounterAlreadyPresent, CounterCreated, CounterUnknown, CounterFailed}
+}
+
+func applyBatch(ctx context.Context, store Store, change Change, batch []entry, progress *jobs.Progress) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	users := make([]int64, 0, len(batch))
+	for _, e := range batch {
+		users = append(users, e.id)
+	}
+
+	var (
+		res                storage.MembersResult
+		err                error
+		changed, unchanged string
+	)
+	switch change.Action {
+	case ActionAdd:
+		res, err = store.AddSegmentMembers(ctx, change.SegmentID, users, change.CreateMissing)
+		changed, unchanged = CounterAdded, CounterAlreadyPresent
+	case ActionRemove:
+		res, err = store.RemoveSegmentMembers(ctx, change.SegmentID, users)
+		changed, unchanged = CounterRemoved, CounterAbsent
+	default:
+		return fmt.Errorf("unknown action %q", change.Action)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, i := range res.Unknown {
+		progress.Fail(batch[i].line, storage.ErrUserNotFound)
+	}
+
+	progress.Add(CounterProcessed, int64(len(batch)))
+	progress.Add(changed, res.Changed)
+	progress.Add(unchanged, res.Unchanged)
+	progress.Add(CounterUnknown, int64(len(res.Unknown)))
+	if change.Action == ActionAdd {
+		progress.Add(CounterCreated, res.Created)
+	}
+
+	return nil
+}
+
+type textReader struct {
+	r    *lines.Reader
+	line int
+}
+
+func newTextReader(r io.Reader) *textReader {
+	return &textReader{r: lines.NewReader(r, maxLineSize)}
+}
+
+func (t *textReader) read() (entry, error) {
+	for {
+		b, tooLong, err := t.r.Read()
+		if err != nil {
+			return entry{}, err
+		}
+		t.line++
+
+		if tooLong {
+			return entry{}, &entryError{line: t.line, err: fmt.Errorf("line is longer than %d bytes", maxLineSize)}
+		}
+
+		field, _, _ := strings.Cut(string(b), ",")
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil && t.line == 1 {
+			continue
+		}
+		if err != nil {
+			return entry{}, &entryError{line: t.line, err: fmt.Errorf("invalid user id %q", field)}
+		}
+		if id == 0 {
+			return entry{}, &entryError{line: t.line, err: errUserIDRequired}
+		}
+
+		return entry{line: t.line, id: id}, nil
+	}
+}
+
+// jsonReader streams the user_ids array of a JSON object, so that large
+// lists are not decoded at once.
+type jsonReader struct {
+	dec *json.Decoder
+	// inArray tells that the reader is inside the user_ids array.
+	inArray bool
+	line    int
+}
+
+func newJSONReader(r io.Reader) *jsonReader {
+	return &jsonReader{dec: json.NewDecoder(r)}
+}
+
+func (j *jsonReader) read() (entry, error) {
+	if !j.inArray {
+		if err := j.findArray(); err != nil {
+			return entry{}, err
+		}
+		j.inArray = true
+	}
+
+	if !j.dec.More() {
+		return entry{}, io.EOF
+	}
+
+	j.line++
+
+	var id int64
+	if err := j.dec.Decode(&id); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return entry{}, &entryError{line: j.line, err: fmt.Errorf("invalid user id: %w", err)}
+		}
+		return entry{}, err
+	}
+	if id == 0 {
+		return entry{}, &entryError{line: j.line, err: errUserIDRequired}
+	}
+
+	return entry{line: j.line, id: id}, nil
+}
+
+// findArray reads up to the start of the user_ids array skipping other
+// fields of the object.
+func (j *jsonReader) findArray() error {
+	if err := j.expect(json.Delim('{')); err != nil {
+		return err
+	}
+
+	for j.dec.More() {
+		key, err := j.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if key == "user_ids" {
+			return j.expect(json.Delim('['))
+		}
+
+		var skip json.RawMessage
+		if err := j.dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+
+	return errors.New("user_ids is required")
+}
+
+func (j *jsonReader) expect(delim json.Delim) error {
+	token, err := j.dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v, got %v", delim, token)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package bulkmembers
+
+import (
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/storage"
+	"avito-internship/internal/storage/memory"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func runApply(t *testing.T, store Store, input, format string, change Change) jobs.Job {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := jobs.NewQueue(1, time.Hour)
+	go queue.Run(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), 1)
+
+	job, err := queue.Submit("segment_members_bulk", false, func(ctx context.Context, progress *jobs.Progress) error {
+		return Apply(ctx, store, strings.NewReader(input), format, change, 2, progress)
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, err = queue.Get(job.ID)
+		require.NoError(t, err)
+		return job.Finished()
+	}, time.Second, 10*time.Millisecond)
+
+	return job
+}
+
+func newStore(t *testing.T) (*memory.Memory, int64) {
+	t.Helper()
+
+	store := memory.New()
+	id, err := store.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(context.Background(), 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	_, err = store.CreateSegment(context.Background(), "AVITO_DISCOUNT_30", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	require.NoError(t, store.CreateUser(context.Background(), 1001, []string{"AVITO_DISCOUNT_30"}))
+
+	return store, id
+}
+
+func TestApplyText(t *testing.T) {
+	store, id := newStore(t)
+
+	input := "user_id,comment\n" +
+		"1000\n" +
+		"1001,new\n" +
+		"abc\n" +
+		"1002\n"
+
+	job := runApply(t, store, input, FormatText, Change{SegmentID: id, Action: ActionAdd})
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{
+		CounterProcessed:      4,
+		CounterAdded:          1,
+		CounterAlreadyPresent: 1,
+		CounterCreated:        0,
+		CounterUnknown:        1,
+		CounterFailed:         1,
+	}, job.Counters)
+	require.Len(t, job.Errors, 2)
+	require.Equal(t, 4, job.Errors[0].Line)
+	require.Equal(t, 5, job.Errors[1].Line)
+
+	job = runApply(t, store, "1002\n", FormatText, Change{SegmentID: id, Action: ActionAdd, CreateMissing: true})
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.EqualValues(t, 1, job.Counters[CounterCreated])
+	require.EqualValues(t, 1, job.Counters[CounterAdded])
+
+	segments, err := store.ShowActiveSegmentUser(context.Background(), 1002)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+}
+
+func TestApplyTextLongLine(t *testing.T) {
+	store, id := newStore(t)
+
+	input := "1000\n" +
+		strings.Repeat("9", maxLineSize+1) + "\n" +
+		"1001\n"
+
+	job := runApply(t, store, input, FormatText, Change{SegmentID: id, Action: ActionAdd})
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.EqualValues(t, 3, job.Counters[CounterProcessed])
+	require.EqualValues(t, 1, job.Counters[CounterAdded])
+	require.EqualValues(t, 1, job.Counters[CounterAlreadyPresent])
+	require.EqualValues(t, 1, job.Counters[CounterFailed])
+	require.Len(t, job.Errors, 1)
+	require.Equal(t, 2, job.Errors[0].Line)
+}
+
+func TestApplyJSON(t *testing.T) {
+	store, id := newStore(t)
+
+	input := `{"comment": {"a": [1]}, "user_ids": [1000, 1001, "x", 1003]}`
+
+	job := runApply(t, store, input, FormatJSON, Change{SegmentID: id, Action: ActionRemove})
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{
+		CounterProcessed: 4,
+		CounterRemoved:   1,
+		CounterAbsent:    1,
+		CounterUnknown:   1,
+		CounterFailed:    1,
+	}, job.Counters)
+	require.Len(t, job.Errors, 2)
+	require.Equal(t, 3, job.Errors[0].Line)
+	require.Equal(t, 4, job.Errors[1].Line)
+
+	job = runApply(t, store, `{"ids": []}`, FormatJSON, Change{SegmentID: id, Action: ActionRemove})
+	require.Equal(t, jobs.StatusFailed, job.Status)
+}
@@ -11,15 +11,160 @@ import (
 const configPath = "config/local.yaml"
 
 type Config struct {
-	Env          string `yaml:"env" env-default:"local"`
-	PostgresPath string `yaml:"postgres_path" env-required:"true"`
-	HTTPServer   `yaml:"http_server"`
+	Env string `yaml:"env" env-default:"local"`
+	// Storage selects the storage backend: postgres or memory.
+	Storage      string `yaml:"storage" env-default:"postgres"`
+	PostgresPath string `yaml:"postgres_path"`
+	// QueryTimeouts bounds storage operations so that slow queries fail
+	// before the HTTP server timeout.
+	QueryTimeouts `yaml:"query_timeouts"`
+	HTTPServer    `yaml:"http_server"`
+	UploadServer  `yaml:"upload_server"`
+	AdminServer   `yaml:"admin_server"`
+	Sweeper       `yaml:"sweeper"`
+	Health        `yaml:"health"`
+	Tracing       `yaml:"tracing"`
+	Auth          `yaml:"auth"`
+	RateLimit     `yaml:"rate_limit"`
+	Idempotency   `yaml:"idempotency"`
+	Segments      `yaml:"segments"`
+	Jobs          `yaml:"jobs"`
+	Import        `yaml:"import"`
+}
+
+type QueryTimeouts struct {
+	Default time.Duration `yaml:"default" env-default:"3s"`
+	// Operations overrides Default per storage method, e.g. Stats: 1s.
+	Operations map[string]time.Duration `yaml:"operations"`
 }
 
 type HTTPServer struct {
 	Address     string        `yaml:"address" env-default:"localhost:8080"`
 	Timeout     time.Duration `yaml:"timeout" env-default:"4s"`
 	IdleTimeout time.Duration `yaml:"idle_timeout" env-default:"60s"`
+	// ShutdownTimeout bounds draining of in-flight requests and background workers.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env-default:"10s"`
+	// ShutdownDelay is how long the service reports not ready before it stops accepting requests.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" env-default:"0s"`
+}
+
+// UploadServer is a separate listener of uploads, such as user imports,
+// which take longer to read than HTTPServer.Timeout allows.
+type UploadServer struct {
+	Address string `yaml:"address" env-default:"localhost:8082"`
+	// Timeout bounds reading an upload and responding to it.
+	Timeout time.Duration `yaml:"timeout" env-default:"10m"`
+}
+
+// AdminServer is a separate listener for operational endpoints such as
+// metrics, not meant to be exposed publicly.
+type AdminServer struct {
+	Address string `yaml:"address" env-default:"localhost:8081"`
+}
+
+type Sweeper struct {
+	Interval time.Duration `yaml:"interval" env-default:"1m"`
+}
+
+type Health struct {
+	// CheckTimeout bounds all dependency checks of a single readiness probe.
+	CheckTimeout time.Duration `yaml:"check_timeout" env-default:"2s"`
+}
+
+type Tracing struct {
+	// Exporter selects where spans are sent: none, stdout, file or otlp.
+	Exporter    string `yaml:"exporter" env-default:"none"`
+	ServiceName string `yaml:"service_name" env-default:"segment-service"`
+	// SampleRatio is the share of new traces recorded, from 0 to 1.
+	SampleRatio float64 `yaml:"sample_ratio" env-default:"1"`
+	// FilePath is where the file exporter appends spans.
+	FilePath string `yaml:"file_path" env-default:"traces.json"`
+	// OTLPEndpoint is the host:port of the OTLP/HTTP collector.
+	OTLPEndpoint string `yaml:"otlp_endpoint" env-default:"localhost:4318"`
+	OTLPInsecure bool   `yaml:"otlp_insecure" env-default:"true"`
+}
+
+type Auth struct {
+	// BootstrapKey is an API key with all scopes used to issue the first keys.
+	BootstrapKey string `yaml:"bootstrap_key" env:"AUTH_BOOTSTRAP_KEY"`
+	JWT          JWT    `yaml:"jwt"`
+}
+
+// JWT configures bearer token authentication of users. It is disabled
+// unless at least one key file is set.
+type JWT struct {
+	// HMACSecretFile holds the shared secret of HS256 tokens.
+	HMACSecretFile string `yaml:"hmac_secret_file"`
+	// PublicKeyFile is a PEM RSA public key of RS256 tokens.
+	PublicKeyFile string `yaml:"public_key_file"`
+	// JWKSFile is a JWK set of RS256 keys selected by the kid header.
+	JWKSFile string `yaml:"jwks_file"`
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// RolesClaim is the claim holding a role or a list of them.
+	RolesClaim string `yaml:"roles_claim" env-default:"roles"`
+	// RoleMapping maps claim values, e.g. SSO groups, to roles. Values
+	// equal to a role name map to that role.
+	RoleMapping map[string]string `yaml:"role_mapping"`
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration `yaml:"leeway" env-default:"30s"`
+}
+
+// RateLimit configures token bucket limits of API clients.
+type RateLimit struct {
+	// Backend selects where buckets are kept: memory of each instance,
+	// postgres to share them between instances, or none to disable limits.
+	Backend string `yaml:"backend" env-default:"memory"`
+	// Address limits all requests of a remote address before they are
+	// authenticated, Default and Routes limit authenticated clients.
+	Address RateLimitRule `yaml:"address"`
+	Default RateLimitRule `yaml:"default"`
+	// Routes overrides Default per route, keyed by "METHOD /pattern".
+	Routes map[string]RateLimitRule `yaml:"routes"`
+}
+
+type RateLimitRule struct {
+	// Rate is the number of requests per second, Burst the number of
+	// requests allowed at once. A zero rate disables the limit.
+	Rate  float64 `yaml:"rate" env-default:"10"`
+	Burst int     `yaml:"burst" env-default:"20"`
+}
+
+type Idempotency struct {
+	// TTL is how long responses are replayed for retries with the same key.
+	TTL time.Duration `yaml:"ttl" env-default:"24h"`
+	// MaxBodySize bounds the body of a request made with a key, as the
+	// body is read into memory to be fingerprinted.
+	MaxBodySize int64 `yaml:"max_body_size" env-default:"1048576"`
+}
+
+type Segments struct {
+	// AliasTTL is how long the former name of a renamed segment resolves.
+	AliasTTL time.Duration `yaml:"alias_ttl" env-default:"720h"`
+	// Retention is how long deleted segments can be restored before the
+	// sweeper purges them.
+	Retention time.Duration `yaml:"retention" env-default:"720h"`
+}
+
+// Jobs configures background jobs such as imports.
+type Jobs struct {
+	// Workers is the number of jobs run at once.
+	Workers int `yaml:"workers" env-default:"2"`
+	// QueueSize bounds the jobs waiting for a worker.
+	QueueSize int `yaml:"queue_size" env-default:"16"`
+	// TTL is how long the status of finished jobs is kept.
+	TTL time.Duration `yaml:"ttl" env-default:"24h"`
+}
+
+// Import configures uploads of user imports and bulk segment members.
+type Import struct {
+	// MaxSize bounds an uploaded file in bytes. Uploads must also fit into
+	// UploadServer.Timeout: the default 100 MiB in 10 minutes takes about
+	// 170 KiB/s.
+	MaxSize int64 `yaml:"max_size" env-default:"104857600"`
+	// BatchSize is the number of users changed in one transaction.
+	BatchSize int `yaml:"batch_size" env-default:"1000"`
 }
 
 func MustConfigLoad() *Config {
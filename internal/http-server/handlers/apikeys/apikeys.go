@@ -0,0 +1,192 @@
+package apikeys
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
+	"avito-internship/internal/lib/auth"
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/slog"
+)
+
+type Request struct {
+	Name   string   `json:"name" validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1,unique,dive,scope"`
+}
+
+// Response carries the plain key. It is shown only once and cannot be
+// recovered later.
+type Response struct {
+	resp.Response
+	ID     int64    `json:"id"`
+	Key    string   `json:"key"`
+	Name   string   `json:"name,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+type KeyCreator interface {
+	CreateAPIKey(ctx context.Context, name string, hash []byte, scopes []string) (int64, error)
+}
+
+type KeyRotator interface {
+	RotateAPIKey(ctx context.Context, id int64, hash []byte) error
+}
+
+type KeyRevoker interface {
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+// Create issues a new API key with the requested scopes.
+func Create(log *slog.Logger, creator KeyCreator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.Create"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		var req Request
+
+		err := render.DecodeJSON(r.Body, &req)
+		if err != nil {
+			log.Error("failed to decode request body", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
+
+			return
+		}
+
+		if err := validate.Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
+
+			return
+		}
+
+		key, err := auth.GenerateKey()
+		if err != nil {
+			log.Error("failed to generate API key", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		id, err := creator.CreateAPIKey(r.Context(), req.Name, auth.HashKey(key), req.Scopes)
+		if err != nil {
+			log.Error("failed to create API key", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("API key created", slog.Int64("key_id", id), slog.Any("scopes", req.Scopes))
+
+		render.Status(r, http.StatusCreated)
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			ID:       id,
+			Key:      key,
+			Name:     req.Name,
+			Scopes:   req.Scopes,
+		})
+	}
+}
+
+// Rotate replaces the key from the URL with a new one keeping its scopes.
+// The old key stops working immediately.
+func Rotate(log *slog.Logger, rotator KeyRotator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.Rotate"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid key id", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("invalid key id"))
+
+			return
+		}
+
+		key, err := auth.GenerateKey()
+		if err != nil {
+			log.Error("failed to generate API key", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		if err := rotator.RotateAPIKey(r.Context(), id, auth.HashKey(key)); err != nil {
+			log.Error("failed to rotate API key", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("API key rotated", slog.Int64("key_id", id))
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			ID:       id,
+			Key:      key,
+		})
+	}
+}
+
+// Revoke revokes the key from the URL.
+func Revoke(log *slog.Logger, revoker KeyRevoker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.apikeys.Revoke"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid key id", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("invalid key id"))
+
+			return
+		}
+
+		if err := revoker.RevokeAPIKey(r.Context(), id); err != nil {
+			log.Error("failed to revoke API key", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("API key revoked", slog.Int64("key_id", id))
+
+		render.JSON(w, r, resp.OK())
+	}
+}
@@ -0,0 +1,30 @@
+package docs
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// OpenAPI is the OpenAPI 3 document describing every route of the service.
+//
+//go:embed openapi.json
+var OpenAPI []byte
+
+//go:embed swagger.html
+var swaggerUI []byte
+
+// Spec serves the OpenAPI document.
+func Spec() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(OpenAPI)
+	}
+}
+
+// UI serves Swagger UI rendering the document from Spec.
+func UI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(swaggerUI)
+	}
+}
@@ -0,0 +1,128 @@
+package health
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/lib/readiness"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	StatusOK          = "OK"
+	StatusUnavailable = "Unavailable"
+	StatusError       = "Error"
+)
+
+// Check is a named dependency check run by Ready.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Response struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Live reports the process is alive.
+func Live() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		render.JSON(w, r, Response{Status: StatusOK})
+	}
+}
+
+// Ready reports whether the service can serve traffic: it is not shutting
+// down and every check passes within timeout. It replies 503 otherwise.
+func Ready(log *slog.Logger, ready *readiness.Flag, timeout time.Duration, checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.health.Ready"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+		)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		res := Response{
+			Status: StatusOK,
+			Checks: make(map[string]CheckResult, len(checks)+1),
+		}
+
+		if !ready.Ready() {
+			res.Status = StatusUnavailable
+			res.Checks["lifecycle"] = CheckResult{Status: StatusError, Error: "service is not ready"}
+		} else {
+			res.Checks["lifecycle"] = CheckResult{Status: StatusOK}
+		}
+
+		var (
+			wg sync.WaitGroup
+			mu sync.Mutex
+		)
+		for _, check := range checks {
+			check := check
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				err := runCheck(ctx, check)
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					log.Error("readiness check failed", slog.String("check", check.Name), slog.String("error", err.Error()))
+
+					res.Status = StatusUnavailable
+					res.Checks[check.Name] = CheckResult{Status: StatusError, Error: err.Error()}
+
+					return
+				}
+
+				res.Checks[check.Name] = CheckResult{Status: StatusOK}
+			}()
+		}
+		wg.Wait()
+
+		if res.Status != StatusOK {
+			render.Status(r, http.StatusServiceUnavailable)
+		}
+
+		render.JSON(w, r, res)
+	}
+}
+
+// runCheck runs the check and gives up once ctx is done even if the
+// check itself ignores the context.
+func runCheck(ctx context.Context, check Check) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- check.Check(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.New("check timed out")
+		}
+		return ctx.Err()
+	}
+}
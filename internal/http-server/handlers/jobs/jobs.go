@@ -0,0 +1,191 @@
+// Package jobs contains the representation of background jobs and the
+// handler reporting their progress.
+package jobs
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/logger/slogger"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+// Job is a background job in responses.
+type Job struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	DryRun bool   `json:"dry_run"`
+	// Counters are the progress of the job, e.g. processed rows.
+	Counters map[string]int64 `json:"counters"`
+	Errors   []RowError       `json:"errors"`
+	// ErrorsTruncated tells that more rows failed than Errors lists.
+	ErrorsTruncated bool       `json:"errors_truncated,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	FinishedAt      *time.Time `json:"finished_at,omitempty"`
+}
+
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+type Response struct {
+	resp.Response
+	Job Job `json:"job"`
+}
+
+// FromJob converts the job snapshot.
+func FromJob(job jobs.Job) Job {
+	errs := make([]RowError, 0, len(job.Errors))
+	for _, e := range job.Errors {
+		errs = append(errs, RowError{Line: e.Line, Error: e.Error})
+	}
+
+	res := Job{
+		ID:              job.ID,
+		Kind:            job.Kind,
+		Status:          job.Status,
+		DryRun:          job.DryRun,
+		Counters:        job.Counters,
+		Errors:          errs,
+		ErrorsTruncated: job.ErrorsTruncated,
+		Error:           job.Error,
+		CreatedAt:       job.CreatedAt,
+	}
+	if !job.StartedAt.IsZero() {
+		res.StartedAt = &job.StartedAt
+	}
+	if !job.FinishedAt.IsZero() {
+		res.FinishedAt = &job.FinishedAt
+	}
+
+	return res
+}
+
+// Location is the URL the job is reported at.
+func Location(job jobs.Job) string {
+	return "/jobs/" + job.ID
+}
+
+// Accepted writes the submitted job with its Location.
+func Accepted(w http.ResponseWriter, r *http.Request, job jobs.Job) {
+	w.Header().Set("Location", Location(job))
+	render.Status(r, http.StatusAccepted)
+	render.JSON(w, r, Response{
+		Response: resp.OK(),
+		Job:      FromJob(job),
+	})
+}
+
+// WriteSubmitError writes why a job could not be submitted.
+func WriteSubmitError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, jobs.ErrQueueFull) {
+		resp.WriteProblem(w, r, resp.NewProblem(http.StatusServiceUnavailable, resp.CodeJobQueueFull,
+			"too many jobs are queued, retry later"))
+
+		return
+	}
+
+	resp.WriteError(w, r, err)
+}
+
+// Upload saves the request body of up to maxSize bytes to a temporary
+// file, so that a job can read it after the response is sent. If it fails,
+// the problem is written and nil is returned.
+func Upload(log *slog.Logger, w http.ResponseWriter, r *http.Request, maxSize int64) *os.File {
+	f, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		log.Error("failed to create temporary file", slogger.Err(err))
+
+		resp.WriteError(w, r, err)
+
+		return nil
+	}
+
+	size, err := io.Copy(f, http.MaxBytesReader(w, r.Body, maxSize))
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		Discard(f)
+
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			log.Error("upload is too large", slog.Int64("max_size", maxSize))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusRequestEntityTooLarge, resp.CodePayloadTooLarge,
+				"upload must not exceed "+strconv.FormatInt(maxSize, 10)+" bytes"))
+
+			return nil
+		}
+
+		log.Error("failed to read upload", slogger.Err(err))
+
+		resp.WriteProblem(w, r, resp.BadRequest("failed to read upload"))
+
+		return nil
+	}
+
+	log.Debug("upload saved", slog.Int64("size", size))
+
+	return f
+}
+
+// Discard closes and removes the file saved by Upload.
+func Discard(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+type JobGetter interface {
+	Get(id string) (jobs.Job, error)
+}
+
+// Get reports the progress of the job with the id URL parameter.
+func Get(log *slog.Logger, getter JobGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.jobs.Get"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		id := chi.URLParam(r, "id")
+
+		job, err := getter.Get(id)
+		if errors.Is(err, jobs.ErrJobNotFound) {
+			log.Info("job not found", slog.String("job_id", id))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusNotFound, resp.CodeJobNotFound, err.Error()))
+
+			return
+		}
+		if err != nil {
+			log.Error("failed to get job", slog.String("job_id", id), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			Job:      FromJob(job),
+		})
+	}
+}
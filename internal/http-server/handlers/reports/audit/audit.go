@@ -0,0 +1,105 @@
+package audit
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+)
+
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+type AuditGetter interface {
+	SegmentAudit(ctx context.Context, from, to time.Time) ([]storage.AuditRecord, error)
+}
+
+// New streams the segment audit trail of the requested month as a CSV report.
+func New(log *slog.Logger, auditGetter AuditGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.reports.audit.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		query := r.URL.Query()
+
+		year, err := strconv.Atoi(query.Get("year"))
+		if err != nil || year < 1 {
+			log.Error("invalid year", slog.String("year", query.Get("year")))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed, "invalid year"))
+
+			return
+		}
+
+		month, err := strconv.Atoi(query.Get("month"))
+		if err != nil || month < 1 || month > 12 {
+			log.Error("invalid month", slog.String("month", query.Get("month")))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed, "invalid month"))
+
+			return
+		}
+
+		from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+
+		records, err := auditGetter.SegmentAudit(r.Context(), from, to)
+		if err != nil {
+			log.Error("failed to get audit trail", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"audit_%04d_%02d.csv\"", year, month))
+
+		cw := csv.NewWriter(w)
+		cw.Comma = ';'
+
+		if err := cw.Write([]string{"segment", "action", "actor", "datetime", "previous_name"}); err != nil {
+			log.Error("failed to write report", slogger.Err(err))
+
+			return
+		}
+
+		for _, record := range records {
+			err := cw.Write([]string{
+				record.Segment,
+				record.Action,
+				record.Actor,
+				record.CreatedAt.UTC().Format(dateTimeLayout),
+				record.PreviousName,
+			})
+			if err != nil {
+				log.Error("failed to write report", slogger.Err(err))
+
+				return
+			}
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Error("failed to write report", slogger.Err(err))
+
+			return
+		}
+
+		log.Info("audit report sent", slog.Int("records", len(records)))
+	}
+}
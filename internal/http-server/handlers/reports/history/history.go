@@ -0,0 +1,157 @@
+package history
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+const dateTimeLayout = "2006-01-02 15:04:05"
+
+type Response struct {
+	resp.Response
+	Link string `json:"link,omitempty"`
+}
+
+type HistoryGetter interface {
+	History(ctx context.Context, from, to time.Time, fn func(storage.HistoryRecord) error) error
+}
+
+// New streams the membership history of the requested month as a CSV report.
+// With link=true the handler replies with a link to download the report instead.
+func New(log *slog.Logger, historyGetter HistoryGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.reports.history.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		query := r.URL.Query()
+
+		year, err := strconv.Atoi(query.Get("year"))
+		if err != nil || year < 1 {
+			log.Error("invalid year", slog.String("year", query.Get("year")))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed, "invalid year"))
+
+			return
+		}
+
+		month, err := strconv.Atoi(query.Get("month"))
+		if err != nil || month < 1 || month > 12 {
+			log.Error("invalid month", slog.String("month", query.Get("month")))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed, "invalid month"))
+
+			return
+		}
+
+		if link, _ := strconv.ParseBool(query.Get("link")); link {
+			render.JSON(w, r, Response{
+				Response: resp.OK(),
+				Link:     downloadLink(r, year, month),
+			})
+
+			return
+		}
+
+		from := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+		to := from.AddDate(0, 1, 0)
+
+		cw := csv.NewWriter(w)
+		cw.Comma = ';'
+
+		// The report is written as the records are read. Once it started,
+		// a failure can only cut the response short.
+		var records int
+		err = historyGetter.History(r.Context(), from, to, func(record storage.HistoryRecord) error {
+			if records == 0 {
+				if err := writeHeader(w, cw, year, month); err != nil {
+					return err
+				}
+			}
+			records++
+
+			return cw.Write([]string{
+				strconv.FormatInt(record.UserID, 10),
+				record.Segment,
+				record.Operation,
+				record.CreatedAt.UTC().Format(dateTimeLayout),
+				record.Actor,
+			})
+		})
+		if err != nil && records == 0 {
+			log.Error("failed to get history", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+		if err != nil {
+			log.Error("failed to write report", slog.Int("records", records), slogger.Err(err))
+
+			return
+		}
+
+		if records == 0 {
+			if err := writeHeader(w, cw, year, month); err != nil {
+				log.Error("failed to write report", slogger.Err(err))
+
+				return
+			}
+		}
+
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Error("failed to write report", slogger.Err(err))
+
+			return
+		}
+
+		log.Info("history report sent", slog.Int("records", records))
+	}
+}
+
+// writeHeader starts the CSV report of the month.
+func writeHeader(w http.ResponseWriter, cw *csv.Writer, year, month int) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=\"history_%04d_%02d.csv\"", year, month))
+
+	return cw.Write([]string{"user_id", "segment", "operation", "datetime", "actor"})
+}
+
+func downloadLink(r *http.Request, year, month int) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	query := url.Values{}
+	query.Set("year", strconv.Itoa(year))
+	query.Set("month", strconv.Itoa(month))
+
+	link := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawQuery: query.Encode(),
+	}
+
+	return link.String()
+}
@@ -1,11 +1,14 @@
 package del
 
 import (
+	"avito-internship/internal/http-server/handlers/segments"
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"net/http"
 
-	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/go-playground/validator/v10"
 	"golang.org/x/exp/slog"
@@ -21,16 +24,19 @@ type Response struct {
 }
 
 type DeleteSegment interface {
-	DeleteSegment(segmentName string) (int64, error)
+	DeleteSegment(ctx context.Context, segmentName string) (int64, error)
+	segments.AliasResolver
 }
 
 func DelSeg(log *slog.Logger, segmentDelete DeleteSegment) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.segments.delete.DelSeg"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
 		var req Request
@@ -39,29 +45,30 @@ func DelSeg(log *slog.Logger, segmentDelete DeleteSegment) http.HandlerFunc {
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
 
 			return
 		}
 
-		segmentID, err := segmentDelete.DeleteSegment(req.SegmentName)
+		segments.DeprecateAliases(r.Context(), w, log, segmentDelete, req.SegmentName)
+
+		segmentID, err := segmentDelete.DeleteSegment(r.Context(), req.SegmentName)
 		if err != nil {
 			log.Error("failed to delete segment", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to delete segment"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
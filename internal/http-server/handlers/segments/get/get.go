@@ -0,0 +1,59 @@
+package get
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+type Response struct {
+	resp.Response
+	Segment segments.Segment `json:"segment"`
+}
+
+type SegmentGetter interface {
+	GetSegment(ctx context.Context, slug string) (storage.Segment, error)
+}
+
+// New returns the segment named by the slug URL parameter with its
+// metadata. The slug may be a former name of the segment.
+func New(log *slog.Logger, segmentGetter SegmentGetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.get.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		segment, err := segmentGetter.GetSegment(r.Context(), slug)
+		if err != nil {
+			log.Error("failed to get segment", slog.String("segment", slug), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("segment retrieved", slog.String("segment", slug))
+
+		segments.DeprecateAlias(w, slug, segment)
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			Segment:  segments.FromStorage(segment),
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package list
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 200
+)
+
+type Response struct {
+	resp.Response
+	Segments []segments.Segment `json:"segments"`
+	// NextCursor is passed as cursor to get the next page, it is empty on
+	// the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+type SegmentLister interface {
+	ListSegments(ctx context.Context, filter storage.SegmentFilter) ([]storage.Segment, error)
+}
+
+// cursor is the opaque position in the list returned as next_cursor. It
+// remembers the order it was issued for.
+type cursor struct {
+	Sort      string    `json:"s"`
+	Desc      bool      `json:"d,omitempty"`
+	Name      string    `json:"n"`
+	CreatedAt time.Time `json:"t"`
+}
+
+// New lists segments page by page with optional search by name, tag and
+// owner.
+func New(log *slog.Logger, lister SegmentLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.list.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		query := r.URL.Query()
+
+		filter := storage.SegmentFilter{
+			Sort:     storage.SortByName,
+			Prefix:   query.Get("prefix"),
+			Contains: query.Get("contains"),
+			Tag:      query.Get("tag"),
+			Owner:    query.Get("owner"),
+			Limit:    defaultLimit,
+		}
+
+		if v := query.Get("limit"); v != "" {
+			limit, err := strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > maxLimit {
+				log.Error("invalid limit", slog.String("limit", v))
+
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+					"limit must be from 1 to "+strconv.Itoa(maxLimit)))
+
+				return
+			}
+			filter.Limit = limit
+		}
+
+		switch sort := query.Get("sort"); sort {
+		case "", storage.SortByName:
+		case storage.SortByCreatedAt:
+			filter.Sort = storage.SortByCreatedAt
+		default:
+			log.Error("invalid sort", slog.String("sort", sort))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+				"sort must be name or created_at"))
+
+			return
+		}
+
+		switch order := query.Get("order"); order {
+		case "", "asc":
+		case "desc":
+			filter.Desc = true
+		default:
+			log.Error("invalid order", slog.String("order", order))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+				"order must be asc or desc"))
+
+			return
+		}
+
+		if v := query.Get("with_members"); v != "" {
+			withMembers, err := strconv.ParseBool(v)
+			if err != nil {
+				log.Error("invalid with_members", slog.String("with_members", v))
+
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+					"with_members must be a boolean"))
+
+				return
+			}
+			filter.WithMembers = withMembers
+		}
+
+		if v := query.Get("cursor"); v != "" {
+			c, err := decodeCursor(v)
+			if err != nil || c.Sort != filter.Sort || c.Desc != filter.Desc {
+				log.Error("invalid cursor", slog.String("cursor", v))
+
+				resp.WriteProblem(w, r, resp.BadRequest("invalid cursor or it was issued for another order"))
+
+				return
+			}
+			filter.After = &storage.Segment{Name: c.Name, CreatedAt: c.CreatedAt}
+		}
+
+		// One more segment tells whether there is a next page.
+		limit := filter.Limit
+		filter.Limit++
+
+		page, err := lister.ListSegments(r.Context(), filter)
+		if err != nil {
+			log.Error("failed to list segments", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		res := Response{
+			Response: resp.OK(),
+			Segments: make([]segments.Segment, 0, len(page)),
+		}
+
+		if len(page) > limit {
+			page = page[:limit]
+
+			last := page[limit-1]
+			res.NextCursor = encodeCursor(cursor{
+				Sort:      filter.Sort,
+				Desc:      filter.Desc,
+				Name:      last.Name,
+				CreatedAt: last.CreatedAt,
+			})
+		}
+
+		for _, segment := range page {
+			s := segments.FromStorage(segment)
+			if filter.WithMembers {
+				members := segment.Members
+				s.Members = &members
+			}
+			res.Segments = append(res.Segments, s)
+		}
+
+		log.Info("segments listed", slog.Int("segments", len(res.Segments)))
+
+		render.JSON(w, r, res)
+	}
+}
+
+func encodeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, err
+	}
+
+	var c cursor
+	err = json.Unmarshal(b, &c)
+	return c, err
+}
@@ -0,0 +1,135 @@
+package members
+
+import (
+	"avito-internship/internal/bulkmembers"
+	jobstatus "avito-internship/internal/http-server/handlers/jobs"
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+)
+
+// Kind is the kind of bulk membership jobs.
+const Kind = "segment_members_bulk"
+
+// formats maps content types to input formats.
+var formats = map[string]string{
+	"application/json": bulkmembers.FormatJSON,
+	"text/plain":       bulkmembers.FormatText,
+	"text/csv":         bulkmembers.FormatText,
+}
+
+type SegmentGetter interface {
+	GetSegment(ctx context.Context, slug string) (storage.Segment, error)
+}
+
+type JobSubmitter interface {
+	Submit(kind string, dryRun bool, task jobs.Task) (jobs.Job, error)
+}
+
+// Bulk adds the users listed in the body to the segment named by the slug
+// URL parameter, or removes them with action=remove, in the background in
+// batches of batchSize users. The body of up to maxSize bytes is a JSON
+// object with user_ids or a file with a user id per line.
+func Bulk(log *slog.Logger, getter SegmentGetter, submitter JobSubmitter, store bulkmembers.Store, maxSize int64, batchSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.members.Bulk"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format, ok := formats[mediaType]
+		if !ok {
+			log.Error("unsupported content type", slog.String("content_type", mediaType))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnsupportedMediaType, resp.CodeUnsupportedMediaType,
+				"content type must be application/json, text/plain or text/csv"))
+
+			return
+		}
+
+		query := r.URL.Query()
+
+		change := bulkmembers.Change{Action: query.Get("action")}
+		if change.Action != bulkmembers.ActionAdd && change.Action != bulkmembers.ActionRemove {
+			log.Error("invalid action", slog.String("action", change.Action))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+				"action must be add or remove"))
+
+			return
+		}
+
+		if v := query.Get("create_missing"); v != "" {
+			createMissing, err := strconv.ParseBool(v)
+			if err != nil || createMissing && change.Action != bulkmembers.ActionAdd {
+				log.Error("invalid create_missing", slog.String("create_missing", v))
+
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+					"create_missing must be a boolean and is only allowed with action=add"))
+
+				return
+			}
+			change.CreateMissing = createMissing
+		}
+
+		slug := chi.URLParam(r, "slug")
+
+		segment, err := getter.GetSegment(r.Context(), slug)
+		if err != nil {
+			log.Error("failed to get segment", slog.String("segment", slug), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+		// The job keeps working if the segment is renamed meanwhile.
+		change.SegmentID = segment.ID
+
+		f := jobstatus.Upload(log, w, r, maxSize)
+		if f == nil {
+			return
+		}
+
+		actor := storage.ActorFromContext(r.Context())
+
+		job, err := submitter.Submit(Kind, false, func(ctx context.Context, progress *jobs.Progress) error {
+			defer jobstatus.Discard(f)
+
+			return bulkmembers.Apply(storage.WithActor(ctx, actor), store, f, format, change, batchSize, progress)
+		})
+		if err != nil {
+			jobstatus.Discard(f)
+
+			log.Error("failed to submit bulk change", slogger.Err(err))
+
+			jobstatus.WriteSubmitError(w, r, err)
+
+			return
+		}
+
+		log.Info("bulk change submitted",
+			slog.String("job_id", job.ID),
+			slog.String("segment", segment.Name),
+			slog.String("action", change.Action),
+			slog.Bool("create_missing", change.CreateMissing),
+		)
+
+		segments.DeprecateAlias(w, slug, segment)
+		jobstatus.Accepted(w, r, job)
+	}
+}
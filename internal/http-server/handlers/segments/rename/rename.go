@@ -0,0 +1,90 @@
+package rename
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/slog"
+)
+
+type Request struct {
+	Name string `json:"name" validate:"required,name"`
+}
+
+type Response struct {
+	resp.Response
+	Segment segments.Segment `json:"segment"`
+}
+
+type SegmentRenamer interface {
+	RenameSegment(ctx context.Context, slug, name string, aliasExpiresAt time.Time) (storage.Segment, error)
+	segments.AliasResolver
+}
+
+// New renames the segment named by the slug URL parameter. Its former name
+// keeps resolving for aliasTTL.
+func New(log *slog.Logger, segmentRenamer SegmentRenamer, aliasTTL time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.rename.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		var req Request
+
+		err := render.DecodeJSON(r.Body, &req)
+		if err != nil {
+			log.Error("failed to decode request body", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
+
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validate.Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
+
+			return
+		}
+
+		segments.DeprecateAliases(r.Context(), w, log, segmentRenamer, slug)
+
+		segment, err := segmentRenamer.RenameSegment(r.Context(), slug, req.Name, time.Now().Add(aliasTTL))
+		if err != nil {
+			log.Error("failed to rename segment", slog.String("segment", slug), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("segment renamed", slog.String("segment", slug), slog.String("name", segment.Name))
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			Segment:  segments.FromStorage(segment),
+		})
+	}
+}
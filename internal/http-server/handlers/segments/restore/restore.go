@@ -0,0 +1,60 @@
+package restore
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"golang.org/x/exp/slog"
+)
+
+type Response struct {
+	resp.Response
+	Segment segments.Segment `json:"segment"`
+}
+
+type SegmentRestorer interface {
+	RestoreSegment(ctx context.Context, slug string, deletedAfter time.Time) (storage.Segment, error)
+}
+
+// New restores the segment named by the slug URL parameter if it was
+// deleted less than retention ago.
+func New(log *slog.Logger, segmentRestorer SegmentRestorer, retention time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.restore.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		segment, err := segmentRestorer.RestoreSegment(r.Context(), slug, time.Now().Add(-retention))
+		if err != nil {
+			log.Error("failed to restore segment", slog.String("segment", slug), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("segment restored", slog.String("segment", slug), slog.Int64("id", segment.ID))
+
+		segments.DeprecateAlias(w, slug, segment)
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			Segment:  segments.FromStorage(segment),
+		})
+	}
+}
@@ -1,8 +1,13 @@
 package save
 
 import (
+	"avito-internship/internal/http-server/handlers/segments"
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"errors"
 	"net/http"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,6 +18,10 @@ import (
 
 type Request struct {
 	SegmentName string `json:"name" validate:"required,name"`
+	// AutoPercent is the share of users, existing and future ones,
+	// automatically enrolled into the segment.
+	AutoPercent int `json:"auto_percent,omitempty" validate:"min=0,max=100"`
+	segments.Meta
 }
 
 type Response struct {
@@ -21,16 +30,18 @@ type Response struct {
 }
 
 type SegmentCreator interface {
-	CreateSegment(segment string) (int64, error)
+	CreateSegment(ctx context.Context, segment string, autoPercent int, meta storage.SegmentMeta) (int64, error)
 }
 
 func New(log *slog.Logger, segmentCreator SegmentCreator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.segments.save.New"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
 		var req Request
@@ -39,44 +50,45 @@ func New(log *slog.Logger, segmentCreator SegmentCreator) http.HandlerFunc {
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
 
 			return
 		}
 
-		id, err := segmentCreator.CreateSegment(req.SegmentName)
-		if err != nil {
+		id, err := segmentCreator.CreateSegment(r.Context(), req.SegmentName, req.AutoPercent, req.Meta.Storage())
+		if errors.Is(err, storage.ErrSegmentExists) {
 			log.Info("segment name already exists", slog.String("segment", req.SegmentName))
 
-			render.JSON(w, r, resp.Error("segment already exists"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 		if err != nil {
 			log.Error("failed to add segment", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to add segment"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 
-		log.Info("segment added", slog.Int64("id", id))
+		log.Info("segment added", slog.Int64("id", id), slog.Int("auto_percent", req.AutoPercent))
 
+		render.Status(r, http.StatusCreated)
 		render.JSON(w, r, Response{
-			Response: resp.OK(),
+			Response:    resp.OK(),
+			SegmentName: req.SegmentName,
 		})
 	}
 }
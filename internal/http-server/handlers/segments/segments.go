@@ -0,0 +1,149 @@
+// Package segments contains the segment representation shared by the
+// segment handlers.
+package segments
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Meta is the editable metadata of a segment in requests.
+type Meta struct {
+	Description string `json:"description,omitempty" validate:"max=1024"`
+	// Owner is the team owning the segment.
+	Owner string   `json:"owner,omitempty" validate:"max=128"`
+	Tags  []string `json:"tags,omitempty" validate:"max=32,unique,dive,required,max=64"`
+}
+
+// Storage converts m to the metadata kept by the storage.
+func (m Meta) Storage() storage.SegmentMeta {
+	return storage.SegmentMeta{
+		Description: m.Description,
+		Owner:       m.Owner,
+		Tags:        m.Tags,
+	}
+}
+
+// Segment is a segment in responses.
+type Segment struct {
+	// ID is kept when the segment is renamed.
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	AutoPercent int       `json:"auto_percent"`
+	Description string    `json:"description"`
+	Owner       string    `json:"owner"`
+	Tags        []string  `json:"tags"`
+	CreatedBy   string    `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Members is set only if the member count was requested.
+	Members *int64 `json:"members,omitempty"`
+	// Aliases are former names of the segment which still resolve.
+	Aliases []Alias `json:"aliases,omitempty"`
+}
+
+type Alias struct {
+	Name      string    `json:"name"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FromStorage converts the stored segment without its member count.
+func FromStorage(segment storage.Segment) Segment {
+	tags := segment.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	var aliases []Alias
+	for _, alias := range segment.Aliases {
+		aliases = append(aliases, Alias{Name: alias.Name, ExpiresAt: alias.ExpiresAt})
+	}
+
+	return Segment{
+		ID:          segment.ID,
+		Name:        segment.Name,
+		AutoPercent: segment.AutoPercent,
+		Description: segment.Description,
+		Owner:       segment.Owner,
+		Tags:        tags,
+		CreatedBy:   segment.CreatedBy,
+		CreatedAt:   segment.CreatedAt,
+		UpdatedAt:   segment.UpdatedAt,
+		Aliases:     aliases,
+	}
+}
+
+// DeprecateAlias marks the response as deprecated if slug is an alias of
+// the segment rather than its name: Sunset is when the alias expires and
+// Link points to the segment by its name.
+func DeprecateAlias(w http.ResponseWriter, slug string, segment storage.Segment) {
+	if slug == segment.Name {
+		return
+	}
+
+	deprecate(w, map[string]storage.Segment{slug: segment})
+}
+
+// AliasResolver looks segments up by their aliases.
+type AliasResolver interface {
+	SegmentsByAlias(ctx context.Context, slugs []string) (map[string]storage.Segment, error)
+}
+
+// DeprecateAliases marks the response as deprecated, like DeprecateAlias,
+// if any of slugs is an alias. It is called before the request changes
+// the segments, as a rename or deletion changes what the slugs name. A
+// failed lookup is only logged, the request does not depend on it.
+func DeprecateAliases(ctx context.Context, w http.ResponseWriter, log *slog.Logger, aliasResolver AliasResolver, slugs ...string) {
+	aliases, err := aliasResolver.SegmentsByAlias(ctx, slugs)
+	if err != nil {
+		log.Warn("failed to look up segment aliases", slogger.Err(err))
+
+		return
+	}
+
+	deprecate(w, aliases)
+}
+
+// deprecate sets the deprecation headers for the segments by alias: Sunset
+// is when the first of the aliases expires and Link points to every
+// segment by its name.
+func deprecate(w http.ResponseWriter, aliases map[string]storage.Segment) {
+	if len(aliases) == 0 {
+		return
+	}
+
+	slugs := make([]string, 0, len(aliases))
+	for slug := range aliases {
+		slugs = append(slugs, slug)
+	}
+	sort.Strings(slugs)
+
+	w.Header().Set("Deprecation", "true")
+
+	var sunset time.Time
+	linked := make(map[string]bool, len(aliases))
+	for _, slug := range slugs {
+		segment := aliases[slug]
+		if !linked[segment.Name] {
+			linked[segment.Name] = true
+			w.Header().Add("Link", "</segments/"+url.PathEscape(segment.Name)+`>; rel="alternate"`)
+		}
+
+		for _, alias := range segment.Aliases {
+			if alias.Name == slug && (sunset.IsZero() || alias.ExpiresAt.Before(sunset)) {
+				sunset = alias.ExpiresAt
+			}
+		}
+	}
+
+	if !sunset.IsZero() {
+		w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+	}
+}
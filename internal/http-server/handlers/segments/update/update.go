@@ -0,0 +1,89 @@
+package update
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/slog"
+)
+
+// Request replaces the whole metadata: omitted fields are cleared.
+type Request struct {
+	segments.Meta
+}
+
+type Response struct {
+	resp.Response
+	Segment segments.Segment `json:"segment"`
+}
+
+type SegmentUpdater interface {
+	UpdateSegment(ctx context.Context, slug string, meta storage.SegmentMeta) (storage.Segment, error)
+}
+
+// New replaces the metadata of the segment named by the slug URL
+// parameter. The slug may be a former name of the segment.
+func New(log *slog.Logger, segmentUpdater SegmentUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.segments.update.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		slug := chi.URLParam(r, "slug")
+
+		var req Request
+
+		err := render.DecodeJSON(r.Body, &req)
+		if err != nil {
+			log.Error("failed to decode request body", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
+
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validate.Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
+
+			return
+		}
+
+		segment, err := segmentUpdater.UpdateSegment(r.Context(), slug, req.Meta.Storage())
+		if err != nil {
+			log.Error("failed to update segment", slog.String("segment", slug), slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("segment updated", slog.String("segment", slug))
+
+		segments.DeprecateAlias(w, slug, segment)
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			Segment:  segments.FromStorage(segment),
+		})
+	}
+}
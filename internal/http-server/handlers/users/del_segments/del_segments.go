@@ -1,76 +1,92 @@
 package delsegments
 
 import (
+	"avito-internship/internal/http-server/handlers/segments"
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"net/http"
+	"strconv"
 
-	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/go-playground/validator/v10"
 	"golang.org/x/exp/slog"
 )
 
 type Request struct {
-	SegmentName string `json:"segment_name" validate:"required"`
+	Segments []string `json:"segments" validate:"required,min=1,unique"`
 }
 
 type Response struct {
 	resp.Response
-	SegmentID int64 `json:"id,omitempty"`
 }
 
-type DeleteSegment interface {
-	DeleteSegment(segmentName string) (int64, error)
+type SegmentsRemover interface {
+	RemoveSegmentsFromUser(ctx context.Context, user_id int64, segments []string) error
+	segments.AliasResolver
 }
 
-func DelSeg(log *slog.Logger, segmentDelete DeleteSegment) http.HandlerFunc {
+func DelSeg(log *slog.Logger, segmentsRemover SegmentsRemover) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		const op = "handlers.segments.delete.DelSeg"
+		const op = "handlers.users.del_segments.DelSeg"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid user id", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("invalid user id"))
+
+			return
+		}
+
 		var req Request
 
-		err := render.DecodeJSON(r.Body, &req)
+		err = render.DecodeJSON(r.Body, &req)
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
 
 			return
 		}
 
-		segmentID, err := segmentDelete.DeleteSegment(req.SegmentName)
+		segments.DeprecateAliases(r.Context(), w, log, segmentsRemover, req.Segments...)
+
+		err = segmentsRemover.RemoveSegmentsFromUser(r.Context(), userID, req.Segments)
 		if err != nil {
-			log.Error("failed to delete segment", slogger.Err(err))
+			log.Error("failed to remove segments from user", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to delete segment"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 
-		log.Info("segment deleted", slog.Int64("id", segmentID))
+		log.Info("segments removed from user", slog.Int64("user_id", userID))
 
 		render.JSON(w, r, Response{
-			Response:  resp.OK(),
-			SegmentID: segmentID,
+			Response: resp.OK(),
 		})
 	}
 }
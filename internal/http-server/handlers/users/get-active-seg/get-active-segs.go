@@ -3,70 +3,59 @@ package getactiveseg
 import (
 	resp "avito-internship/internal/lib/api/response"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"net/http"
+	"strconv"
 
-	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	"github.com/go-playground/validator/v10"
 	"golang.org/x/exp/slog"
 )
 
-type Request struct {
-	UserID int64 `json:"id" validate:"required"`
-}
-
 type Response struct {
 	resp.Response
 	Segments []string `json:"segments"`
 }
 
 type UserSegments interface {
-	ShowActiveSegmentUser(user_id int64) ([]string, error)
+	ShowActiveSegmentUser(ctx context.Context, user_id int64) ([]string, error)
 }
 
 func GetActiveSegmentsForUser(log *slog.Logger, userSegments UserSegments) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.users.get.active.segments"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
-		var req Request
-
-		err := render.DecodeJSON(r.Body, &req)
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
 		if err != nil {
-			log.Error("failed to decode request body", slogger.Err(err))
-
-			render.JSON(w, r, resp.Error("failed to decode request"))
-
-			return
-		}
-
-		log.Info("request body decoded", slog.Any("request", req))
-
-		if err := validator.New().Struct(req); err != nil {
-			validateErr := err.(validator.ValidationErrors)
+			log.Error("invalid user id", slogger.Err(err))
 
-			log.Error("invalid request", slogger.Err(err))
-
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.BadRequest("invalid user id"))
 
 			return
 		}
 
-		segments, err := userSegments.ShowActiveSegmentUser(req.UserID)
+		segments, err := userSegments.ShowActiveSegmentUser(r.Context(), userID)
 		if err != nil {
 			log.Error("failed to get active segments for user", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to get active segments for user"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 
-		log.Info("active segments for user retrieved", slog.Int64("user_id", req.UserID), slog.Any("segments", segments))
+		log.Info("active segments for user retrieved", slog.Int64("user_id", userID), slog.Any("segments", segments))
+
+		if segments == nil {
+			segments = []string{}
+		}
 
 		render.JSON(w, r, Response{
 			Response: resp.OK(),
@@ -0,0 +1,102 @@
+package importusers
+
+import (
+	jobstatus "avito-internship/internal/http-server/handlers/jobs"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"avito-internship/internal/userimport"
+	"context"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+)
+
+// Kind is the kind of import jobs.
+const Kind = "users_import"
+
+// formats maps content types to input formats.
+var formats = map[string]string{
+	"text/csv":             userimport.FormatCSV,
+	"application/x-ndjson": userimport.FormatNDJSON,
+	"application/jsonl":    userimport.FormatNDJSON,
+}
+
+type JobSubmitter interface {
+	Submit(kind string, dryRun bool, task jobs.Task) (jobs.Job, error)
+}
+
+// New accepts a CSV or NDJSON file of up to maxSize bytes and imports it
+// in the background in batches of batchSize users. The response reports
+// the job, its progress is at the Location header.
+func New(log *slog.Logger, submitter JobSubmitter, importer userimport.Store, maxSize int64, batchSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.import_users.New"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		format, ok := formats[mediaType]
+		if !ok {
+			log.Error("unsupported content type", slog.String("content_type", mediaType))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnsupportedMediaType, resp.CodeUnsupportedMediaType,
+				"content type must be text/csv or application/x-ndjson"))
+
+			return
+		}
+
+		var dryRun bool
+		if v := r.URL.Query().Get("dry_run"); v != "" {
+			var err error
+			dryRun, err = strconv.ParseBool(v)
+			if err != nil {
+				log.Error("invalid dry_run", slog.String("dry_run", v))
+
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed,
+					"dry_run must be a boolean"))
+
+				return
+			}
+		}
+
+		f := jobstatus.Upload(log, w, r, maxSize)
+		if f == nil {
+			return
+		}
+
+		actor := storage.ActorFromContext(r.Context())
+
+		job, err := submitter.Submit(Kind, dryRun, func(ctx context.Context, progress *jobs.Progress) error {
+			defer jobstatus.Discard(f)
+
+			return userimport.Import(storage.WithActor(ctx, actor), importer, f, format, batchSize, dryRun, progress)
+		})
+		if err != nil {
+			jobstatus.Discard(f)
+
+			log.Error("failed to submit import", slogger.Err(err))
+
+			jobstatus.WriteSubmitError(w, r, err)
+
+			return
+		}
+
+		log.Info("import submitted",
+			slog.String("job_id", job.ID),
+			slog.String("format", format),
+			slog.Bool("dry_run", dryRun),
+		)
+
+		jobstatus.Accepted(w, r, job)
+	}
+}
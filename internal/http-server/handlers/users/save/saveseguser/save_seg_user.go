@@ -2,7 +2,9 @@ package saveseguser
 
 import (
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"net/http"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,7 +15,7 @@ import (
 
 type Request struct {
 	UserID   int64    `json:"userId" validate:"required"`
-	Segments []string `json:"segments" validate:"required"`
+	Segments []string `json:"segments" validate:"required,min=1,unique"`
 }
 
 type Response struct {
@@ -22,16 +24,18 @@ type Response struct {
 }
 
 type AddUserToSegment interface {
-	AddUserToSegment(userID int64, segmentSlugs []string) error
+	AddUserToSegment(ctx context.Context, userID int64, segmentSlugs []string) error
 }
 
 func AddUserToSegments(log *slog.Logger, addUserToSegment AddUserToSegment) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.users.save.AddUserToSegments"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
 		var req Request
@@ -40,29 +44,28 @@ func AddUserToSegments(log *slog.Logger, addUserToSegment AddUserToSegment) http
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
 
 			return
 		}
 
-		err = addUserToSegment.AddUserToSegment(req.UserID, req.Segments)
+		err = addUserToSegment.AddUserToSegment(r.Context(), req.UserID, req.Segments)
 		if err != nil {
 			log.Error("failed to add segments to user", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to add segments to user"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
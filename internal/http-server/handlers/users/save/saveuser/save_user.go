@@ -1,8 +1,11 @@
 package saveuser
 
 import (
+	"avito-internship/internal/http-server/handlers/segments"
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"net/http"
 
 	"github.com/go-chi/chi/v5/middleware"
@@ -13,7 +16,7 @@ import (
 
 type Request struct {
 	UserId   int64    `json:"userId" validate:"required"`
-	Segments []string `json:"segments" validate:"required"`
+	Segments []string `json:"segments" validate:"required,min=1,unique"`
 }
 
 type Response struct {
@@ -22,16 +25,19 @@ type Response struct {
 }
 
 type UserCreator interface {
-	CreateUser(user_id int64, segments []string) error
+	CreateUser(ctx context.Context, user_id int64, segments []string) error
+	segments.AliasResolver
 }
 
 func New(log *slog.Logger, userCreator UserCreator) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.users.save.New"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
 		var req Request
@@ -40,34 +46,36 @@ func New(log *slog.Logger, userCreator UserCreator) http.HandlerFunc {
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
 
 			return
 		}
 
-		if err := userCreator.CreateUser(req.UserId, req.Segments); err != nil {
+		segments.DeprecateAliases(r.Context(), w, log, userCreator, req.Segments...)
+
+		if err := userCreator.CreateUser(r.Context(), req.UserId, req.Segments); err != nil {
 			log.Error("failed to create user", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to create user"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 
 		log.Info("user created", slog.Int64("userId", req.UserId))
 
+		render.Status(r, http.StatusCreated)
 		render.JSON(w, r, Response{
 			Response: resp.OK(),
 			UserId:   req.UserId,
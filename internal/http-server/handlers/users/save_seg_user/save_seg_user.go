@@ -1,10 +1,17 @@
 package save_seg_user
 
 import (
+	"avito-internship/internal/http-server/handlers/segments"
 	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
 	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
 	"github.com/go-playground/validator/v10"
@@ -12,8 +19,10 @@ import (
 )
 
 type Request struct {
-	UserID   int64    `json:"user_id" validate:"required"`
-	Segments []string `json:"segments" validate:"required"`
+	Segments []string `json:"segments" validate:"required,min=1,unique"`
+	// Expires optionally maps a segment to its expiry: either an RFC 3339
+	// timestamp ("2026-10-01T00:00:00Z") or a duration from now ("72h").
+	Expires map[string]string `json:"expires,omitempty"`
 }
 
 type Response struct {
@@ -21,55 +30,112 @@ type Response struct {
 }
 
 type AddUserToSegment interface {
-	AddUserToSegment(user_id int64, segment []string) error
+	AddUserToSegment(ctx context.Context, user_id int64, segment []string, expires map[string]time.Time) error
+	segments.AliasResolver
 }
 
 func AddUserToSegments(log *slog.Logger, addUserToSegment AddUserToSegment) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		const op = "handlers.users.save_seg_user.AddUserToSegments"
 
-		log = log.With(
+		log := log.With(
 			slog.String("op", op),
 			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
 		)
 
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid user id", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("invalid user id"))
+
+			return
+		}
+
 		var req Request
 
-		err := render.DecodeJSON(r.Body, &req)
+		err = render.DecodeJSON(r.Body, &req)
 		if err != nil {
 			log.Error("failed to decode request body", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to decode request"))
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
 
 			return
 		}
 
 		log.Info("request body decoded", slog.Any("request", req))
 
-		if err := validator.New().Struct(req); err != nil {
+		if err := validate.Struct(req); err != nil {
 			validateErr := err.(validator.ValidationErrors)
 
 			log.Error("invalid request", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("invalid request"))
-			render.JSON(w, r, resp.ValidationError(validateErr))
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
+
+			return
+		}
+
+		expires, err := parseExpires(req, time.Now())
+		if err != nil {
+			log.Error("invalid expiry", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeValidationFailed, err.Error()))
 
 			return
 		}
 
-		err = addUserToSegment.AddUserToSegment(req.UserID, req.Segments)
+		segments.DeprecateAliases(r.Context(), w, log, addUserToSegment, req.Segments...)
+
+		err = addUserToSegment.AddUserToSegment(r.Context(), userID, req.Segments, expires)
 		if err != nil {
 			log.Error("failed to add segments to user", slogger.Err(err))
 
-			render.JSON(w, r, resp.Error("failed to add segments to user"))
+			resp.WriteError(w, r, err)
 
 			return
 		}
 
-		log.Info("segments added to user", slog.Int64("user_id", req.UserID))
+		log.Info("segments added to user", slog.Int64("user_id", userID))
 
 		render.JSON(w, r, Response{
 			Response: resp.OK(),
 		})
 	}
 }
+
+func parseExpires(req Request, now time.Time) (map[string]time.Time, error) {
+	if len(req.Expires) == 0 {
+		return nil, nil
+	}
+
+	requested := make(map[string]bool, len(req.Segments))
+	for _, segment := range req.Segments {
+		requested[segment] = true
+	}
+
+	expires := make(map[string]time.Time, len(req.Expires))
+	for segment, value := range req.Expires {
+		if !requested[segment] {
+			return nil, fmt.Errorf("expiry set for segment %s which is not being added", segment)
+		}
+
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			ttl, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("expiry of segment %s is neither a timestamp nor a duration", segment)
+			}
+			expiresAt = now.Add(ttl)
+		}
+
+		if !expiresAt.After(now) {
+			return nil, fmt.Errorf("expiry of segment %s must be in the future", segment)
+		}
+
+		expires[segment] = expiresAt
+	}
+
+	return expires, nil
+}
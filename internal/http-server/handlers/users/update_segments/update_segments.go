@@ -0,0 +1,112 @@
+package updatesegments
+
+import (
+	"avito-internship/internal/http-server/handlers/segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/api/validate"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/slog"
+)
+
+type Request struct {
+	Add    []string `json:"add" validate:"required_without=Remove,unique"`
+	Remove []string `json:"remove" validate:"required_without=Add,unique"`
+}
+
+type Response struct {
+	resp.Response
+	UserID   int64    `json:"user_id"`
+	Segments []string `json:"segments"`
+}
+
+type UserSegmentsUpdater interface {
+	UpdateUserSegments(ctx context.Context, user_id int64, add, remove []string) ([]string, error)
+	segments.AliasResolver
+}
+
+// Update adds and removes segments of the user from the URL in a single
+// transaction and replies with the resulting user segments.
+func Update(log *slog.Logger, updater UserSegmentsUpdater) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		const op = "handlers.users.update_segments.Update"
+
+		log := log.With(
+			slog.String("op", op),
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.TraceID(r.Context()),
+			slogger.Principal(r.Context()),
+		)
+
+		userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			log.Error("invalid user id", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("invalid user id"))
+
+			return
+		}
+
+		var req Request
+
+		err = render.DecodeJSON(r.Body, &req)
+		if err != nil {
+			log.Error("failed to decode request body", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.BadRequest("failed to decode request"))
+
+			return
+		}
+
+		log.Info("request body decoded", slog.Any("request", req))
+
+		if err := validate.Struct(req); err != nil {
+			validateErr := err.(validator.ValidationErrors)
+
+			log.Error("invalid request", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.ValidationError(validateErr))
+
+			return
+		}
+
+		if err := storage.CheckSegmentsConflict(req.Add, req.Remove); err != nil {
+			log.Error("invalid request", slogger.Err(err))
+
+			resp.WriteProblem(w, r, resp.NewProblem(http.StatusConflict, resp.CodeSegmentConflict, err.Error()))
+
+			return
+		}
+
+		segments.DeprecateAliases(r.Context(), w, log, updater, append(req.Add, req.Remove...)...)
+
+		active, err := updater.UpdateUserSegments(r.Context(), userID, req.Add, req.Remove)
+		if err != nil {
+			log.Error("failed to update user segments", slogger.Err(err))
+
+			resp.WriteError(w, r, err)
+
+			return
+		}
+
+		log.Info("user segments updated", slog.Int64("user_id", userID), slog.Any("segments", active))
+
+		if active == nil {
+			active = []string{}
+		}
+
+		render.JSON(w, r, Response{
+			Response: resp.OK(),
+			UserID:   userID,
+			Segments: active,
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package auth
+
+import (
+	mwLogger "avito-internship/internal/http-server/middleware/logger"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/auth"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/storage"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+// HeaderAPIKey is the request header carrying the API key.
+const HeaderAPIKey = "X-API-Key"
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request
+	// carries no credentials of its kind, so the next one is tried.
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials is returned by an Authenticator when the
+	// credentials are present but not valid.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator authenticates requests by one kind of credentials.
+type Authenticator interface {
+	Authenticate(r *http.Request) (auth.Principal, error)
+	// Challenge is the WWW-Authenticate challenge of the credentials.
+	Challenge() string
+}
+
+type APIKeyGetter interface {
+	APIKeyByHash(ctx context.Context, hash []byte) (storage.APIKey, error)
+}
+
+type TokenVerifier interface {
+	Verify(token string) (auth.Principal, error)
+}
+
+// New returns a middleware authenticating requests with the first
+// authenticator whose credentials they carry and replying 401 to requests
+// without valid credentials. The caller is recorded as the actor of
+// storage changes made by the request.
+func New(log *slog.Logger, authenticators ...Authenticator) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log := log.With(
+			slog.String("component", "middleware/auth"),
+		)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			log := log.With(
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slogger.TraceID(r.Context()),
+			)
+
+			var (
+				principal auth.Principal
+				err       = ErrNoCredentials
+			)
+			for _, a := range authenticators {
+				principal, err = a.Authenticate(r)
+				if !errors.Is(err, ErrNoCredentials) {
+					break
+				}
+			}
+
+			switch {
+			case errors.Is(err, ErrNoCredentials):
+				log.Warn("request without credentials")
+
+				unauthorized(w, r, authenticators, "credentials are required")
+
+				return
+			case errors.Is(err, ErrInvalidCredentials):
+				log.Warn("request with invalid credentials", slogger.Err(err))
+
+				unauthorized(w, r, authenticators, "credentials are invalid, expired or revoked")
+
+				return
+			case err != nil:
+				log.Error("failed to authenticate request", slogger.Err(err))
+
+				resp.WriteError(w, r, err)
+
+				return
+			}
+
+			log.Info("request authenticated",
+				slog.String("subject", principal.Subject),
+				slog.String("name", principal.Name),
+			)
+
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("auth.subject", principal.Subject))
+
+			ctx := auth.WithPrincipal(r.Context(), principal)
+			ctx = storage.WithActor(ctx, principal.Subject)
+
+			mwLogger.AddAttrs(ctx, slogger.Principal(ctx))
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+type apiKeyAuthenticator struct {
+	keys          APIKeyGetter
+	bootstrapHash []byte
+}
+
+// APIKey authenticates requests by the key in the X-API-Key header.
+// bootstrapKey, if set, is accepted with all scopes so that the first keys
+// can be issued.
+func APIKey(keys APIKeyGetter, bootstrapKey string) Authenticator {
+	a := &apiKeyAuthenticator{keys: keys}
+	if bootstrapKey != "" {
+		a.bootstrapHash = auth.HashKey(bootstrapKey)
+	}
+
+	return a
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (auth.Principal, error) {
+	key := r.Header.Get(HeaderAPIKey)
+	if key == "" {
+		return auth.Principal{}, ErrNoCredentials
+	}
+
+	hash := auth.HashKey(key)
+
+	if a.bootstrapHash != nil && subtle.ConstantTimeCompare(hash, a.bootstrapHash) == 1 {
+		return auth.Principal{Subject: "api-key:bootstrap", Name: "bootstrap", Scopes: auth.Scopes}, nil
+	}
+
+	apiKey, err := a.keys.APIKeyByHash(r.Context(), hash)
+	if errors.Is(err, storage.ErrAPIKeyNotFound) {
+		return auth.Principal{}, ErrInvalidCredentials
+	}
+	if err != nil {
+		return auth.Principal{}, err
+	}
+
+	return auth.Principal{
+		Subject: "api-key:" + strconv.FormatInt(apiKey.ID, 10),
+		KeyID:   apiKey.ID,
+		Name:    apiKey.Name,
+		Scopes:  apiKey.Scopes,
+	}, nil
+}
+
+func (a *apiKeyAuthenticator) Challenge() string {
+	return `ApiKey header="` + HeaderAPIKey + `"`
+}
+
+type bearerAuthenticator struct {
+	verifier TokenVerifier
+}
+
+// Bearer authenticates requests by the JWT in the Authorization header.
+func Bearer(verifier TokenVerifier) Authenticator {
+	return &bearerAuthenticator{verifier: verifier}
+}
+
+func (a *bearerAuthenticator) Authenticate(r *http.Request) (auth.Principal, error) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return auth.Principal{}, ErrNoCredentials
+	}
+
+	principal, err := a.verifier.Verify(strings.TrimSpace(token))
+	if err != nil {
+		return auth.Principal{}, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+
+	return principal, nil
+}
+
+func (a *bearerAuthenticator) Challenge() string {
+	return "Bearer"
+}
+
+// Require returns a middleware replying 403 to requests whose principal
+// lacks scope. Users are granted the scopes of their roles. It must be
+// used after New.
+func Require(scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := auth.PrincipalFromContext(r.Context())
+			if !ok {
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnauthorized, resp.CodeUnauthorized, "credentials are required"))
+
+				return
+			}
+
+			if !principal.HasScope(scope) {
+				resp.WriteProblem(w, r, resp.NewProblem(http.StatusForbidden, resp.CodeForbidden, "caller lacks scope "+scope))
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+func unauthorized(w http.ResponseWriter, r *http.Request, authenticators []Authenticator, detail string) {
+	for _, a := range authenticators {
+		w.Header().Add("WWW-Authenticate", a.Challenge())
+	}
+
+	resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnauthorized, resp.CodeUnauthorized, detail))
+}
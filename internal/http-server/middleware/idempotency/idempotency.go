@@ -0,0 +1,205 @@
+package idempotency
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/auth"
+	"avito-internship/internal/lib/idempotency"
+	"avito-internship/internal/lib/logger/slogger"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// HeaderKey is the request header carrying the idempotency key.
+	HeaderKey = "Idempotency-Key"
+	// HeaderReplayed is set on responses replayed from the store.
+	HeaderReplayed = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+// New returns a middleware making requests with an Idempotency-Key
+// header idempotent: the response of the first request with a key is
+// stored for ttl and replayed on retries with the same key and body.
+// Keys are scoped by the authenticated client.
+//
+// A retry while the first request is in progress gets 409, reusing a key
+// with another request gets 422. Server errors are not stored, so such
+// requests can be retried. lockTimeout bounds how long a request holds
+// its key, e.g. if the instance serving it crashes, and maxBodySize the
+// body read to fingerprint the request.
+func New(log *slog.Logger, store idempotency.Store, ttl, lockTimeout time.Duration, maxBodySize int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log := log.With(
+			slog.String("component", "middleware/idempotency"),
+		)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(HeaderKey)
+			if key == "" {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			log := log.With(
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slog.String("idempotency_key", key),
+			)
+
+			if len(key) > maxKeyLength {
+				resp.WriteProblem(w, r, resp.BadRequest("idempotency key is too long"))
+
+				return
+			}
+
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+			if err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					log.Warn("request body is too large", slog.Int64("max_size", maxBodySize))
+
+					resp.WriteProblem(w, r, resp.NewProblem(http.StatusRequestEntityTooLarge, resp.CodePayloadTooLarge,
+						"request body must not exceed "+strconv.FormatInt(maxBodySize, 10)+" bytes"))
+
+					return
+				}
+
+				log.Error("failed to read request body", slogger.Err(err))
+
+				resp.WriteProblem(w, r, resp.BadRequest("failed to read request"))
+
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+				key = principal.Subject + " " + key
+			}
+
+			token, err := newToken()
+			if err != nil {
+				log.Error("failed to generate reservation token", slogger.Err(err))
+
+				resp.WriteError(w, r, err)
+
+				return
+			}
+
+			fp := fingerprint(r, body)
+			now := time.Now()
+
+			rec, reserved, err := store.Reserve(r.Context(), key, token, fp, now, now.Add(lockTimeout))
+			if err != nil {
+				log.Error("failed to reserve idempotency key", slogger.Err(err))
+
+				resp.WriteError(w, r, err)
+
+				return
+			}
+
+			if !reserved {
+				switch {
+				case !bytes.Equal(rec.Fingerprint, fp):
+					log.Warn("idempotency key reused with another request")
+
+					resp.WriteProblem(w, r, resp.NewProblem(http.StatusUnprocessableEntity, resp.CodeIdempotencyKeyReused,
+						"idempotency key was used with another request"))
+				case !rec.Completed():
+					log.Warn("request with the idempotency key is in progress")
+
+					resp.WriteProblem(w, r, resp.NewProblem(http.StatusConflict, resp.CodeIdempotencyInProgress,
+						"request with the idempotency key is in progress"))
+				default:
+					log.Info("response replayed")
+
+					if rec.ContentType != "" {
+						w.Header().Set("Content-Type", rec.ContentType)
+					}
+					w.Header().Set(HeaderReplayed, "true")
+					w.WriteHeader(rec.Status)
+					w.Write(rec.Body)
+				}
+
+				return
+			}
+
+			// The client may be gone by now, the key must be settled anyway.
+			ctx := trace.ContextWithSpan(context.Background(), trace.SpanFromContext(r.Context()))
+
+			// The key is released unless the response is stored, also when
+			// the handler panics, so that the request can be retried.
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := store.Release(ctx, key, token); err != nil {
+					log.Error("failed to release idempotency key", slogger.Err(err))
+				}
+			}()
+
+			var buf bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&buf)
+
+			next.ServeHTTP(ww, r)
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			if status >= http.StatusInternalServerError {
+				return
+			}
+
+			err = store.Complete(ctx, key, token, status, ww.Header().Get("Content-Type"), buf.Bytes(), time.Now().Add(ttl))
+			if errors.Is(err, idempotency.ErrNotReserved) {
+				log.Warn("idempotency key was taken over, response is not stored")
+
+				completed = true
+
+				return
+			}
+			if err != nil {
+				log.Error("failed to store response", slogger.Err(err))
+
+				return
+			}
+
+			completed = true
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// fingerprint identifies the request by its method, path and body.
+func fingerprint(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// newToken returns a random token identifying a reservation of a key.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,150 @@
+package idempotency
+
+import (
+	"avito-internship/internal/lib/idempotency"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func newHandler(t *testing.T, status *int, calls *int, started, release chan struct{}) http.Handler {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	return New(log, idempotency.NewMemory(), time.Hour, time.Minute, 1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		if release != nil {
+			close(started)
+			<-release
+		}
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(*status)
+		w.Write(body)
+	}))
+}
+
+func do(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/segment", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(HeaderKey, key)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestReplay(t *testing.T) {
+	status, calls := http.StatusCreated, 0
+	h := newHandler(t, &status, &calls, nil, nil)
+
+	first := do(h, "k1", `{"name":"A"}`)
+	require.Equal(t, http.StatusCreated, first.Code)
+
+	retry := do(h, "k1", `{"name":"A"}`)
+	require.Equal(t, http.StatusCreated, retry.Code)
+	require.Equal(t, `{"name":"A"}`, retry.Body.String())
+	require.Equal(t, "application/json", retry.Header().Get("Content-Type"))
+	require.Equal(t, "true", retry.Header().Get(HeaderReplayed))
+	require.Equal(t, 1, calls)
+
+	reused := do(h, "k1", `{"name":"B"}`)
+	require.Equal(t, http.StatusUnprocessableEntity, reused.Code)
+	require.Equal(t, 1, calls)
+
+	// Requests without a key are not deduplicated.
+	do(h, "", `{"name":"A"}`)
+	do(h, "", `{"name":"A"}`)
+	require.Equal(t, 3, calls)
+}
+
+func TestServerErrorIsNotStored(t *testing.T) {
+	status, calls := http.StatusGatewayTimeout, 0
+	h := newHandler(t, &status, &calls, nil, nil)
+
+	require.Equal(t, http.StatusGatewayTimeout, do(h, "k1", `{}`).Code)
+
+	status = http.StatusOK
+	require.Equal(t, http.StatusOK, do(h, "k1", `{}`).Code)
+	require.Equal(t, 2, calls)
+}
+
+func TestInProgress(t *testing.T) {
+	status, calls := http.StatusOK, 0
+	started, release := make(chan struct{}), make(chan struct{})
+	h := newHandler(t, &status, &calls, started, release)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- do(h, "k1", `{}`)
+	}()
+
+	<-started
+	require.Equal(t, http.StatusConflict, do(h, "k1", `{}`).Code)
+
+	close(release)
+	require.Equal(t, http.StatusOK, (<-done).Code)
+}
+
+func TestPanicReleasesKey(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	calls := 0
+	h := New(log, idempotency.NewMemory(), time.Hour, time.Minute, 1024)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	require.Panics(t, func() { do(h, "k1", `{}`) })
+
+	require.Equal(t, http.StatusOK, do(h, "k1", `{}`).Code)
+	require.Equal(t, 2, calls)
+}
+
+func TestBodyTooLarge(t *testing.T) {
+	status, calls := http.StatusOK, 0
+	h := newHandler(t, &status, &calls, nil, nil)
+
+	require.Equal(t, http.StatusRequestEntityTooLarge, do(h, "k1", strings.Repeat("a", 1025)).Code)
+	require.Equal(t, 0, calls)
+}
+
+func TestCompleteRequiresToken(t *testing.T) {
+	store := idempotency.NewMemory()
+	ctx := context.Background()
+	now := time.Now()
+
+	_, reserved, err := store.Reserve(ctx, "k1", "t1", []byte("fp"), now, now.Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	// The reservation expired and another request took the key over.
+	_, reserved, err = store.Reserve(ctx, "k1", "t2", []byte("fp"), now.Add(time.Hour), now.Add(time.Hour+time.Minute))
+	require.NoError(t, err)
+	require.True(t, reserved)
+
+	err = store.Complete(ctx, "k1", "t1", http.StatusOK, "", nil, now.Add(time.Hour))
+	require.ErrorIs(t, err, idempotency.ErrNotReserved)
+
+	require.NoError(t, store.Release(ctx, "k1", "t1"))
+	require.NoError(t, store.Complete(ctx, "k1", "t2", http.StatusCreated, "", nil, now.Add(2*time.Hour)))
+
+	rec, reserved, err := store.Reserve(ctx, "k1", "t3", []byte("fp"), now.Add(time.Hour), now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.False(t, reserved)
+	require.Equal(t, http.StatusCreated, rec.Status)
+}
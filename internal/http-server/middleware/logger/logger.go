@@ -1,12 +1,40 @@
 package logger
 
 import (
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
 	"github.com/go-chi/chi/v5/middleware"
 	"golang.org/x/exp/slog"
 	"net/http"
+	"sync"
 	"time"
 )
 
+type attrsKey struct{}
+
+// requestAttrs holds the attributes added to the request log by the middlewares
+// and handlers running after the logger, e.g. the authenticated principal.
+type requestAttrs struct {
+	mu    sync.Mutex
+	attrs []any
+}
+
+// AddAttrs adds attrs to the log record of the completed request in ctx.
+// It does nothing for requests not logged by the middleware.
+func AddAttrs(ctx context.Context, attrs ...slog.Attr) {
+	e, ok := ctx.Value(attrsKey{}).(*requestAttrs)
+	if !ok {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, attr := range attrs {
+		e.attrs = append(e.attrs, attr)
+	}
+}
+
 func New(log *slog.Logger) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		log = log.With(
@@ -22,17 +50,28 @@ func New(log *slog.Logger) func(next http.Handler) http.Handler {
 				slog.String("remote_addr", r.RemoteAddr),
 				slog.String("user_agent", r.UserAgent()),
 				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slogger.TraceID(r.Context()),
 			)
 
+			e := &requestAttrs{}
+			r = r.WithContext(context.WithValue(r.Context(), attrsKey{}, e))
+
 			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
 
 			t1 := time.Now()
 			defer func() {
-				entry.Info("request completed",
+				e.mu.Lock()
+				attrs := append([]any{
 					slog.Int("status", ww.Status()),
 					slog.Int("bytes", ww.BytesWritten()),
-					slog.String("duration", time.Since(t1).String()))
+					slog.String("duration", time.Since(t1).String()),
+				}, e.attrs...)
+				e.mu.Unlock()
+
+				entry.Info("request completed", attrs...)
 			}()
+
+			next.ServeHTTP(ww, r)
 		}
 
 		return http.HandlerFunc(fn)
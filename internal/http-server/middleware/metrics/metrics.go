@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"avito-internship/internal/lib/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// unmatchedRoute labels requests no route matched, so arbitrary paths do
+// not create new series.
+const unmatchedRoute = "unmatched"
+
+// New returns a middleware counting requests and observing their duration
+// labelled by method, chi route pattern and status.
+func New() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			t1 := time.Now()
+			defer func() {
+				// The pattern is complete only after routing, so read it afterwards.
+				route := unmatchedRoute
+				if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+					route = rctx.RoutePattern()
+				}
+
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+
+				labels := []string{r.Method, route, strconv.Itoa(status)}
+				metrics.HTTPRequests.WithLabelValues(labels...).Inc()
+				metrics.HTTPRequestDuration.WithLabelValues(labels...).Observe(time.Since(t1).Seconds())
+			}()
+
+			next.ServeHTTP(ww, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
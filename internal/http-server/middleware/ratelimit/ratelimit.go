@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/lib/auth"
+	"avito-internship/internal/lib/logger/slogger"
+	"avito-internship/internal/lib/metrics"
+	"avito-internship/internal/lib/ratelimit"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/exp/slog"
+)
+
+// New returns a middleware limiting requests of every client by the limit
+// of the route in policy and replying 429 once the bucket is empty.
+// Clients are identified by the authenticated principal, otherwise by the
+// remote address. It must be used after authentication and routing, i.e.
+// in a chi group.
+//
+// The limiter failing does not fail the request: it is let through.
+func New(log *slog.Logger, limiter ratelimit.Limiter, policy ratelimit.Policy) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log := log.With(
+			slog.String("component", "middleware/ratelimit"),
+		)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			limit, bucket := policy.For(r.Method, chi.RouteContext(r.Context()).RoutePattern())
+
+			client := remoteAddr(r)
+			if principal, ok := auth.PrincipalFromContext(r.Context()); ok {
+				client = principal.Subject
+			}
+
+			if take(log, limiter, w, r, client, bucket, limit) {
+				next.ServeHTTP(w, r)
+			}
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// ByAddress returns a middleware limiting all requests of every remote
+// address by the Address limit of policy. It runs before authentication,
+// so that attempts with invalid credentials are limited too, and must be
+// used after routing, i.e. in a chi group.
+func ByAddress(log *slog.Logger, limiter ratelimit.Limiter, policy ratelimit.Policy) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		log := log.With(
+			slog.String("component", "middleware/ratelimit"),
+		)
+
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if take(log, limiter, w, r, remoteAddr(r), "address", policy.Address) {
+				next.ServeHTTP(w, r)
+			}
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// take takes a token from the bucket of the client and replies 429 if
+// there is none. It tells whether the request may go on.
+func take(log *slog.Logger, limiter ratelimit.Limiter, w http.ResponseWriter, r *http.Request, client, bucket string, limit ratelimit.Limit) bool {
+	if limit.Unlimited() {
+		return true
+	}
+
+	res, err := limiter.Take(r.Context(), client+" "+bucket, limit)
+	if err != nil {
+		log.Error("failed to take rate limit token",
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slogger.Err(err),
+		)
+
+		return true
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+	if !res.Allowed {
+		log.Warn("request rate limited",
+			slog.String("request_id", middleware.GetReqID(r.Context())),
+			slog.String("client", client),
+			slog.String("bucket", bucket),
+		)
+
+		metrics.RateLimited.WithLabelValues(r.Method, chi.RouteContext(r.Context()).RoutePattern()).Inc()
+
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		resp.WriteProblem(w, r, resp.NewProblem(http.StatusTooManyRequests, resp.CodeRateLimited, "rate limit exceeded, retry later"))
+
+		return false
+	}
+
+	return true
+}
+
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// ceilSeconds rounds d up to whole seconds, as the headers carry seconds.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"avito-internship/internal/lib/tracing"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.20.0"
+	"go.opentelemetry.io/otel/semconv/v1.20.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// New returns a middleware starting a server span per request, continuing
+// the trace from the W3C traceparent header if any. The span is named by
+// the chi route pattern once the request is routed.
+func New() func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+			ctx, span := tracing.Start(ctx, r.Method,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(httpconv.ServerRequest("", r)...),
+			)
+			defer span.End()
+
+			if id := middleware.GetReqID(ctx); id != "" {
+				span.SetAttributes(attribute.String("http.request_id", id))
+			}
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			if rctx := chi.RouteContext(ctx); rctx != nil && rctx.RoutePattern() != "" {
+				span.SetName(r.Method + " " + rctx.RoutePattern())
+				span.SetAttributes(semconv.HTTPRoute(rctx.RoutePattern()))
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			span.SetAttributes(semconv.HTTPStatusCode(status))
+			span.SetStatus(httpconv.ServerStatus(status))
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
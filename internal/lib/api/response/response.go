@@ -1,21 +1,21 @@
 package response
 
 import (
+	"avito-internship/internal/storage"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"net/http"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-playground/validator/v10"
 )
 
 type Response struct {
 	Status string `json:"status"`
-	Error  string `json:"error,omitempty"`
 }
 
-const (
-	StatusOK    = "OK"
-	StatusError = "Error"
-)
+const StatusOK = "OK"
 
 func OK() Response {
 	return Response{
@@ -23,29 +23,142 @@ func OK() Response {
 	}
 }
 
-func Error(msg string) Response {
-	return Response{
-		Status: StatusError,
-		Error:  msg,
+const ContentTypeProblem = "application/problem+json"
+
+// Machine-readable error codes of Problem.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeRouteNotFound    = "route_not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeValidationFailed = "validation_failed"
+	CodeSegmentExists    = "segment_exists"
+	CodeSegmentNotFound  = "segment_not_found"
+	CodeSegmentConflict  = "segment_conflict"
+	CodeUserExists       = "user_exists"
+	CodeUserNotFound     = "user_not_found"
+	CodeTimeout          = "timeout"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeAPIKeyNotFound   = "api_key_not_found"
+	CodeRateLimited      = "rate_limited"
+	// CodeIdempotencyKeyReused is returned when an idempotency key is reused
+	// with another request.
+	CodeIdempotencyKeyReused  = "idempotency_key_reused"
+	CodeIdempotencyInProgress = "idempotency_in_progress"
+	CodeUnsupportedMediaType  = "unsupported_media_type"
+	CodePayloadTooLarge       = "payload_too_large"
+	CodeJobQueueFull          = "job_queue_full"
+	CodeJobNotFound           = "job_not_found"
+	CodeInternal              = "internal_error"
+)
+
+// Problem is an RFC 7807 error response extended with a machine-readable code.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes why a single request field is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func NewProblem(status int, code, detail string) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// errorMapping maps storage errors to the problems reported to clients.
+var errorMapping = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{storage.ErrSegmentExists, http.StatusConflict, CodeSegmentExists},
+	{storage.ErrSegmentNotFound, http.StatusNotFound, CodeSegmentNotFound},
+	{storage.ErrSegmentConflict, http.StatusConflict, CodeSegmentConflict},
+	{storage.ErrUserExists, http.StatusConflict, CodeUserExists},
+	{storage.ErrUserNotFound, http.StatusNotFound, CodeUserNotFound},
+	{storage.ErrTimeout, http.StatusGatewayTimeout, CodeTimeout},
+	{storage.ErrAPIKeyNotFound, http.StatusNotFound, CodeAPIKeyNotFound},
+}
+
+// FromError converts err to a problem. Validation errors become 422 with
+// their text, unknown errors become 500 and their text is not exposed to
+// clients.
+func FromError(err error) Problem {
+	var validationErr *storage.ValidationError
+	if errors.As(err, &validationErr) {
+		return NewProblem(http.StatusUnprocessableEntity, CodeValidationFailed, validationErr.Error())
 	}
+
+	for _, m := range errorMapping {
+		if errors.Is(err, m.err) {
+			return NewProblem(m.status, m.code, m.err.Error())
+		}
+	}
+
+	return NewProblem(http.StatusInternalServerError, CodeInternal, "internal error")
 }
 
-func ValidationError(errs validator.ValidationErrors) Response {
-	var errMsgs []string
+func BadRequest(detail string) Problem {
+	return NewProblem(http.StatusBadRequest, CodeInvalidRequest, detail)
+}
+
+func ValidationError(errs validator.ValidationErrors) Problem {
+	problem := NewProblem(http.StatusUnprocessableEntity, CodeValidationFailed, "request validation failed")
 
 	for _, err := range errs {
+		var msg string
+
 		switch err.ActualTag() {
 		case "required":
-			errMsgs = append(errMsgs, fmt.Sprintf("field %s is a required field", err.Field()))
+			msg = fmt.Sprintf("field %s is a required field", err.Field())
 		case "name":
-			errMsgs = append(errMsgs, fmt.Sprintf("field %s is not valid name", err.Field()))
+			msg = fmt.Sprintf("field %s is not valid name", err.Field())
+		case "unique":
+			msg = fmt.Sprintf("field %s must not contain duplicates", err.Field())
+		case "scope":
+			msg = fmt.Sprintf("field %s contains unknown scope", err.Field())
 		default:
-			errMsgs = append(errMsgs, fmt.Sprintf("field %s is not valid", err.Field()))
+			msg = fmt.Sprintf("field %s is not valid", err.Field())
 		}
-	}
 
-	return Response{
-		Status: StatusError,
-		Error:  strings.Join(errMsgs, ", "),
+		problem.Errors = append(problem.Errors, FieldError{
+			Field:   err.Field(),
+			Rule:    err.ActualTag(),
+			Message: msg,
+		})
 	}
+
+	return problem
+}
+
+// WriteProblem writes the problem as application/problem+json.
+func WriteProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	problem.Instance = r.URL.Path
+	problem.RequestID = middleware.GetReqID(r.Context())
+
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(problem.Status)
+
+	json.NewEncoder(w).Encode(problem)
+}
+
+// WriteError writes err mapped to a problem.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	WriteProblem(w, r, FromError(err))
 }
@@ -0,0 +1,43 @@
+package validate
+
+import (
+	"avito-internship/internal/lib/auth"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var segmentNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+
+	// Report fields by their JSON names so clients can match errors to the request.
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	v.RegisterValidation("name", func(fl validator.FieldLevel) bool {
+		return segmentNameRegexp.MatchString(fl.Field().String())
+	})
+
+	v.RegisterValidation("scope", func(fl validator.FieldLevel) bool {
+		return auth.ValidScope(fl.Field().String())
+	})
+
+	return v
+}
+
+// Struct validates request structs. The returned error, if any,
+// is validator.ValidationErrors.
+func Struct(s interface{}) error {
+	return validate.Struct(s)
+}
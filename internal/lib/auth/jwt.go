@@ -0,0 +1,255 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalidToken is returned for tokens that are malformed, expired, not
+// signed by a configured key or have no subject.
+var ErrInvalidToken = errors.New("invalid token")
+
+// JWTVerifier verifies bearer tokens of users and maps their claims to a
+// principal. Keys are read once, so rotating them requires a restart.
+type JWTVerifier struct {
+	parser      *jwt.Parser
+	hmacSecret  []byte
+	rsaKeys     map[string]*rsa.PublicKey
+	rolesClaim  string
+	roleMapping map[string]string
+}
+
+// JWTOptions are the keys and claims checks of a JWTVerifier.
+type JWTOptions struct {
+	// HMACSecretFile holds the shared secret of HS256 tokens.
+	HMACSecretFile string
+	// PublicKeyFile is a PEM RSA public key of RS256 tokens.
+	PublicKeyFile string
+	// JWKSFile is a JWK set of RS256 keys selected by the kid header.
+	JWKSFile string
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+	// RolesClaim is the claim holding a role or a list of them.
+	RolesClaim string
+	// RoleMapping maps claim values to roles. Values equal to a role name
+	// map to that role.
+	RoleMapping map[string]string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// NewJWTVerifier loads the keys set in opts. It returns nil if no key is
+// set, i.e. JWT authentication is disabled.
+func NewJWTVerifier(opts JWTOptions) (*JWTVerifier, error) {
+	const op = "lib.auth.NewJWTVerifier"
+
+	v := &JWTVerifier{
+		rsaKeys:     make(map[string]*rsa.PublicKey),
+		rolesClaim:  opts.RolesClaim,
+		roleMapping: opts.RoleMapping,
+	}
+
+	var methods []string
+
+	if opts.HMACSecretFile != "" {
+		secret, err := os.ReadFile(opts.HMACSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		v.hmacSecret = bytes.TrimSpace(secret)
+		if len(v.hmacSecret) == 0 {
+			return nil, fmt.Errorf("%s: HMAC secret file %s is empty", op, opts.HMACSecretFile)
+		}
+
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+
+	if opts.PublicKeyFile != "" {
+		data, err := os.ReadFile(opts.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+
+		key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", op, opts.PublicKeyFile, err)
+		}
+
+		v.rsaKeys[""] = key
+	}
+
+	if opts.JWKSFile != "" {
+		keys, err := loadJWKS(opts.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", op, opts.JWKSFile, err)
+		}
+
+		for kid, key := range keys {
+			v.rsaKeys[kid] = key
+		}
+	}
+
+	if len(v.rsaKeys) > 0 {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(opts.Leeway),
+	}
+	if opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(opts.Issuer))
+	}
+	if opts.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(opts.Audience))
+	}
+
+	v.parser = jwt.NewParser(parserOpts...)
+
+	return v, nil
+}
+
+// Verify checks the token and returns the user it was issued to with the
+// roles mapped from its claims.
+func (v *JWTVerifier) Verify(token string) (Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.key); err != nil {
+		return Principal{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return Principal{}, fmt.Errorf("%w: subject is missing", ErrInvalidToken)
+	}
+
+	roles := v.roles(claims[v.rolesClaim])
+
+	return Principal{
+		Subject: "user:" + subject,
+		Name:    subject,
+		Roles:   roles,
+		Scopes:  RoleScopes(roles),
+	}, nil
+}
+
+func (v *JWTVerifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		return v.hmacSecret, nil
+	case jwt.SigningMethodRS256.Alg():
+		kid, _ := token.Header["kid"].(string)
+		if key, ok := v.rsaKeys[kid]; ok {
+			return key, nil
+		}
+
+		// A token without kid is accepted if there is a single key.
+		if kid == "" && len(v.rsaKeys) == 1 {
+			for _, key := range v.rsaKeys {
+				return key, nil
+			}
+		}
+
+		return nil, fmt.Errorf("unknown key %q", kid)
+	default:
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+}
+
+// roles maps the roles claim, a string or a list of strings, to known
+// roles. Unknown values are ignored.
+func (v *JWTVerifier) roles(claim interface{}) []string {
+	var values []string
+	switch claim := claim.(type) {
+	case string:
+		values = []string{claim}
+	case []interface{}:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roles []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		role, ok := v.roleMapping[value]
+		if !ok {
+			role = value
+		}
+
+		if ValidRole(role) && !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+
+	return roles
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// loadJWKS returns the RSA signing keys of a JWK set file by kid.
+func loadJWKS(path string) (map[string]*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid modulus: %w", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: invalid exponent: %w", k.Kid, err)
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name string, data []byte) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	return path
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+	require.NoError(t, err)
+	return signed
+}
+
+func TestJWTVerifierHS256(t *testing.T) {
+	v, err := NewJWTVerifier(JWTOptions{
+		HMACSecretFile: writeFile(t, "secret", []byte("secret\n")),
+		Issuer:         "sso",
+		RolesClaim:     "groups",
+		RoleMapping:    map[string]string{"segment-admins": RoleAdmin},
+	})
+	require.NoError(t, err)
+
+	exp := time.Now().Add(time.Hour).Unix()
+
+	principal, err := v.Verify(sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{
+		"sub": "alice", "iss": "sso", "exp": exp, "groups": []string{"segment-admins", "unknown"},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "user:alice", principal.Subject)
+	require.Equal(t, []string{RoleAdmin}, principal.Roles)
+	require.True(t, principal.HasScope(ScopeKeysAdmin))
+
+	principal, err = v.Verify(sign(t, jwt.SigningMethodHS256, []byte("secret"), "", jwt.MapClaims{
+		"sub": "bob", "iss": "sso", "exp": exp, "groups": RoleViewer,
+	}))
+	require.NoError(t, err)
+	require.True(t, principal.HasScope(ScopeSegmentsRead))
+	require.False(t, principal.HasScope(ScopeSegmentsWrite))
+
+	invalid := []jwt.MapClaims{
+		{"sub": "alice", "iss": "sso", "exp": time.Now().Add(-time.Hour).Unix()},
+		{"sub": "alice", "iss": "other", "exp": exp},
+		{"sub": "alice", "iss": "sso"},
+		{"iss": "sso", "exp": exp},
+	}
+	for _, claims := range invalid {
+		_, err := v.Verify(sign(t, jwt.SigningMethodHS256, []byte("secret"), "", claims))
+		require.ErrorIs(t, err, ErrInvalidToken)
+	}
+
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.MapClaims{"sub": "alice", "iss": "sso", "exp": exp}))
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWTVerifierJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	set, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	require.NoError(t, err)
+
+	v, err := NewJWTVerifier(JWTOptions{JWKSFile: writeFile(t, "jwks.json", set), RolesClaim: "roles"})
+	require.NoError(t, err)
+
+	claims := jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{RoleEditor}}
+
+	principal, err := v.Verify(sign(t, jwt.SigningMethodRS256, key, "k1", claims))
+	require.NoError(t, err)
+	require.Equal(t, []string{RoleEditor}, principal.Roles)
+	require.True(t, principal.HasScope(ScopeUsersWrite))
+
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, key, "k2", claims))
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// HS256 is not configured, so the public key cannot be used as a secret.
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, key.N.Bytes(), "k1", claims))
+	require.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestJWTVerifierDisabled(t *testing.T) {
+	v, err := NewJWTVerifier(JWTOptions{})
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
@@ -0,0 +1,38 @@
+package auth
+
+// Roles of users authenticated by JWT. Each role includes the previous one.
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// roleScopes maps a role to the scopes it grants, so routes check users
+// and API keys the same way.
+var roleScopes = map[string][]string{
+	RoleViewer: {ScopeSegmentsRead, ScopeReportsRead},
+	RoleEditor: {ScopeSegmentsRead, ScopeReportsRead, ScopeSegmentsWrite, ScopeUsersWrite},
+	RoleAdmin:  Scopes,
+}
+
+// ValidRole tells whether role is one of the known roles.
+func ValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// RoleScopes returns the scopes granted by roles, unknown roles grant none.
+func RoleScopes(roles []string) []string {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, role := range roles {
+		for _, scope := range roleScopes[role] {
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes
+}
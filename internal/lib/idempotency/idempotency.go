@@ -0,0 +1,158 @@
+// Package idempotency stores responses of requests made with an
+// Idempotency-Key so that retries of the requests are replayed.
+package idempotency
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Record is the state of an idempotency key.
+type Record struct {
+	// Fingerprint identifies the request made with the key.
+	Fingerprint []byte
+	// Status is 0 while the first request with the key is in progress.
+	Status      int
+	ContentType string
+	Body        []byte
+	ExpiresAt   time.Time
+}
+
+// Completed tells whether the response of the request is stored.
+func (r Record) Completed() bool {
+	return r.Status != 0
+}
+
+// ErrNotReserved is returned when the key is no longer held by the token,
+// e.g. the reservation expired and another request took the key over.
+var ErrNotReserved = errors.New("idempotency key is not reserved")
+
+type Store interface {
+	// Reserve stores a pending record of key held by token unless there is
+	// a record of key not expired by now, which is returned with false
+	// instead.
+	Reserve(ctx context.Context, key, token string, fingerprint []byte, now, expiresAt time.Time) (Record, bool, error)
+	// Complete stores the response of the request holding key with token.
+	// It fails with ErrNotReserved if the key is not held by token.
+	Complete(ctx context.Context, key, token string, status int, contentType string, body []byte, expiresAt time.Time) error
+	// Release removes key if it is held by token, so that the request can
+	// be retried.
+	Release(ctx context.Context, key, token string) error
+	// DeleteExpired removes records expired by now and returns their number.
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+// Memory is a store kept in process memory, so retries are only replayed
+// by the same instance of the service.
+type Memory struct {
+	mu      sync.Mutex
+	records map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	Record
+	token string
+}
+
+var _ Store = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		records: make(map[string]memoryRecord),
+	}
+}
+
+func (m *Memory) Reserve(_ context.Context, key, token string, fingerprint []byte, now, expiresAt time.Time) (Record, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.records[key]; ok && rec.ExpiresAt.After(now) {
+		return rec.Record, false, nil
+	}
+
+	m.records[key] = memoryRecord{
+		Record: Record{Fingerprint: fingerprint, ExpiresAt: expiresAt},
+		token:  token,
+	}
+
+	return Record{}, true, nil
+}
+
+func (m *Memory) Complete(_ context.Context, key, token string, status int, contentType string, body []byte, expiresAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rec, ok := m.records[key]
+	if !ok || rec.token != token || rec.Completed() {
+		return ErrNotReserved
+	}
+
+	rec.Status = status
+	rec.ContentType = contentType
+	rec.Body = body
+	rec.ExpiresAt = expiresAt
+	m.records[key] = rec
+
+	return nil
+}
+
+func (m *Memory) Release(_ context.Context, key, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.records[key]; ok && rec.token == token && !rec.Completed() {
+		delete(m.records, key)
+	}
+
+	return nil
+}
+
+func (m *Memory) DeleteExpired(_ context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for key, rec := range m.records {
+		if !rec.ExpiresAt.After(now) {
+			delete(m.records, key)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// RunCleanup periodically deletes expired records until ctx is done.
+func RunCleanup(ctx context.Context, log *slog.Logger, store Store, interval time.Duration) {
+	const op = "lib.idempotency.RunCleanup"
+
+	log = log.With(
+		slog.String("op", op),
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := store.DeleteExpired(ctx, time.Now())
+			if err != nil {
+				log.Error("failed to delete expired idempotency keys", slogger.Err(err))
+
+				continue
+			}
+
+			if deleted > 0 {
+				log.Debug("expired idempotency keys deleted", slog.Int64("deleted", deleted))
+			}
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package jobs runs long operations, such as bulk imports, in the
+// background and tracks their progress by job id.
+package jobs
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+var (
+	ErrQueueFull   = errors.New("job queue is full")
+	ErrJobNotFound = errors.New("job not found")
+)
+
+// Statuses of a job.
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// maxErrors bounds the row errors kept per job.
+const maxErrors = 1000
+
+// RowError is why a single row of the job input failed.
+type RowError struct {
+	// Line is the line of the row in the input.
+	Line  int
+	Error string
+}
+
+// Job is a snapshot of a submitted job.
+type Job struct {
+	ID     string
+	Kind   string
+	Status string
+	DryRun bool
+	// Counters are the progress of the job by name, e.g. processed rows.
+	Counters map[string]int64
+	Errors   []RowError
+	// ErrorsTruncated tells that more rows failed than Errors keeps.
+	ErrorsTruncated bool
+	// Error is why the job failed.
+	Error      string
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Finished tells whether the job succeeded or failed.
+func (j Job) Finished() bool {
+	return j.Status == StatusSucceeded || j.Status == StatusFailed
+}
+
+// Task does the work of a job and reports its progress.
+type Task func(ctx context.Context, progress *Progress) error
+
+// Queue keeps jobs in process memory, so the status of a job is only
+// known to the instance of the service it was submitted to.
+type Queue struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+	// ttl is how long finished jobs are kept.
+	ttl     time.Duration
+	pending chan *job
+}
+
+type job struct {
+	Job
+	task Task
+}
+
+// NewQueue returns a queue holding up to size jobs waiting for a worker.
+func NewQueue(size int, ttl time.Duration) *Queue {
+	return &Queue{
+		jobs:    make(map[string]*job),
+		ttl:     ttl,
+		pending: make(chan *job, size),
+	}
+}
+
+// Submit queues the task. It returns ErrQueueFull if too many jobs wait
+// for a worker.
+func (q *Queue) Submit(kind string, dryRun bool, task Task) (Job, error) {
+	const op = "lib.jobs.Submit"
+
+	id, err := newID()
+	if err != nil {
+		return Job{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	j := &job{
+		Job: Job{
+			ID:        id,
+			Kind:      kind,
+			Status:    StatusQueued,
+			DryRun:    dryRun,
+			Counters:  make(map[string]int64),
+			CreatedAt: time.Now(),
+		},
+		task: task,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(j.CreatedAt)
+
+	select {
+	case q.pending <- j:
+	default:
+		return Job{}, fmt.Errorf("%s: %w", op, ErrQueueFull)
+	}
+
+	q.jobs[id] = j
+
+	return j.snapshot(), nil
+}
+
+// Get returns the job. It returns ErrJobNotFound if there is no such job
+// or it finished more than the queue TTL ago.
+func (q *Queue) Get(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.expire(time.Now())
+
+	j, ok := q.jobs[id]
+	if !ok {
+		return Job{}, ErrJobNotFound
+	}
+
+	return j.snapshot(), nil
+}
+
+// Run runs queued jobs with the given number of workers until ctx is
+// done. Jobs still queued then are run with the done ctx, so that they
+// fail at once and release their resources.
+func (q *Queue) Run(ctx context.Context, log *slog.Logger, workers int) {
+	const op = "lib.jobs.Run"
+
+	log = log.With(
+		slog.String("op", op),
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-q.pending:
+					q.run(ctx, log, j)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for {
+		select {
+		case j := <-q.pending:
+			q.run(ctx, log, j)
+		default:
+			return
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, log *slog.Logger, j *job) {
+	log = log.With(
+		slog.String("job_id", j.ID),
+		slog.String("kind", j.Kind),
+	)
+
+	q.mu.Lock()
+	j.Status = StatusRunning
+	j.StartedAt = time.Now()
+	q.mu.Unlock()
+
+	log.Info("job started")
+
+	err := q.runTask(ctx, j)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j.FinishedAt = time.Now()
+	if err != nil {
+		j.Status = StatusFailed
+		j.Error = err.Error()
+
+		log.Error("job failed", slogger.Err(err))
+
+		return
+	}
+
+	j.Status = StatusSucceeded
+
+	log.Info("job succeeded", slog.Any("counters", j.Counters))
+}
+
+// runTask runs the task of j reporting a panic as an error.
+func (q *Queue) runTask(ctx context.Context, j *job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return j.task(ctx, &Progress{queue: q, job: j})
+}
+
+// expire must be called with q.mu held.
+func (q *Queue) expire(now time.Time) {
+	for id, j := range q.jobs {
+		if j.Finished() && now.Sub(j.FinishedAt) > q.ttl {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// snapshot must be called with the queue mutex held.
+func (j *job) snapshot() Job {
+	s := j.Job
+
+	s.Counters = make(map[string]int64, len(j.Counters))
+	for name, n := range j.Counters {
+		s.Counters[name] = n
+	}
+	s.Errors = append([]RowError(nil), j.Errors...)
+
+	return s
+}
+
+// Progress reports the progress of a running job.
+type Progress struct {
+	queue *Queue
+	job   *job
+}
+
+// Add adds n to the counter.
+func (p *Progress) Add(counter string, n int64) {
+	p.queue.mu.Lock()
+	defer p.queue.mu.Unlock()
+
+	p.job.Counters[counter] += n
+}
+
+// Fail records why the row at line failed.
+func (p *Progress) Fail(line int, err error) {
+	p.queue.mu.Lock()
+	defer p.queue.mu.Unlock()
+
+	if len(p.job.Errors) == maxErrors {
+		p.job.ErrorsTruncated = true
+		return
+	}
+
+	p.job.Errors = append(p.job.Errors, RowError{Line: line, Error: err.Error()})
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
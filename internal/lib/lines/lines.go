@@ -0,0 +1,57 @@
+// Package lines reads text input line by line with a bound on the length
+// of a line.
+package lines
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Reader reads lines of at most max bytes. Longer lines are skipped rather
+// than failing the input, so that they can be reported as invalid rows.
+type Reader struct {
+	r   *bufio.Reader
+	buf []byte
+	max int
+}
+
+// NewReader returns a Reader of lines of at most max bytes from r.
+func NewReader(r io.Reader, max int) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024), max: max}
+}
+
+// Read returns the next line without its line ending, or io.EOF at the end
+// of the input. A line longer than max is not kept: tooLong is set and the
+// input is read on after the line. The line is valid until the next call.
+func (r *Reader) Read() (_ []byte, tooLong bool, _ error) {
+	r.buf = r.buf[:0]
+
+	for {
+		chunk, err := r.r.ReadSlice('\n')
+		if !tooLong {
+			r.buf = append(r.buf, chunk...)
+		}
+
+		if errors.Is(err, bufio.ErrBufferFull) {
+			if len(r.buf) > r.max {
+				tooLong = true
+				r.buf = r.buf[:0]
+			}
+			continue
+		}
+
+		// The last line may have no line ending.
+		if errors.Is(err, io.EOF) && (len(r.buf) > 0 || tooLong) {
+			err = nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		line := bytes.TrimSuffix(bytes.TrimSuffix(r.buf, []byte("\n")), []byte("\r"))
+
+		return line, tooLong || len(line) > r.max, nil
+	}
+}
@@ -1,6 +1,12 @@
 package slogger
 
-import "golang.org/x/exp/slog"
+import (
+	"avito-internship/internal/lib/auth"
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+)
 
 func Err(err error) slog.Attr {
 	return slog.Attr{
@@ -8,3 +14,31 @@ func Err(err error) slog.Attr {
 		Value: slog.StringValue(err.Error()),
 	}
 }
+
+// TraceID returns the trace id of the span in ctx. The attribute is empty,
+// and so omitted from records, when ctx is not traced.
+func TraceID(ctx context.Context) slog.Attr {
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if !spanCtx.HasTraceID() {
+		return slog.Attr{}
+	}
+
+	return slog.String("trace_id", spanCtx.TraceID().String())
+}
+
+// Principal returns the authenticated caller in ctx: its subject and, for
+// API keys, the key id. The attribute is empty when ctx is not
+// authenticated.
+func Principal(ctx context.Context) slog.Attr {
+	principal, ok := auth.PrincipalFromContext(ctx)
+	if !ok {
+		return slog.Attr{}
+	}
+
+	attrs := []any{slog.String("subject", principal.Subject)}
+	if principal.KeyID != 0 {
+		attrs = append(attrs, slog.Int64("key_id", principal.KeyID))
+	}
+
+	return slog.Group("principal", attrs...)
+}
@@ -0,0 +1,118 @@
+// Package metrics contains the Prometheus metrics exported by the service.
+package metrics
+
+import (
+	"avito-internship/internal/storage"
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "segment_service"
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of handled HTTP requests by method, route pattern and status.",
+	}, []string{"method", "route", "status"})
+
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of handled HTTP requests by method, route pattern and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "rate_limited_total",
+		Help:      "Number of HTTP requests rejected by the rate limiter by method and route pattern.",
+	}, []string{"method", "route"})
+
+	StorageQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "storage",
+		Name:      "query_duration_seconds",
+		Help:      "Duration of storage operations by operation name.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"op"})
+)
+
+// Register registers the service metrics along with Go runtime and
+// process collectors.
+func Register(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		HTTPRequests,
+		HTTPRequestDuration,
+		RateLimited,
+		StorageQueryDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ObserveQuery records the duration of the storage operation op started at
+// start. It is meant to be deferred at the top of a storage method.
+func ObserveQuery(op string, start time.Time) {
+	StorageQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+type StatsProvider interface {
+	Stats(ctx context.Context) (storage.Stats, error)
+}
+
+var (
+	segmentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "storage", "segments"),
+		"Number of segments.",
+		nil, nil,
+	)
+	membershipsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "storage", "memberships"),
+		"Number of active user memberships in segments.",
+		nil, nil,
+	)
+)
+
+type storageCollector struct {
+	stats   StatsProvider
+	timeout time.Duration
+}
+
+// NewStorageCollector returns a collector reading segment and membership
+// counts from stats on every scrape, waiting at most timeout.
+func NewStorageCollector(stats StatsProvider, timeout time.Duration) prometheus.Collector {
+	return &storageCollector{stats: stats, timeout: timeout}
+}
+
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- segmentsDesc
+	ch <- membershipsDesc
+}
+
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	stats, err := c.stats.Stats(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(segmentsDesc, err)
+		ch <- prometheus.NewInvalidMetric(membershipsDesc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(stats.Segments))
+	ch <- prometheus.MustNewConstMetric(membershipsDesc, prometheus.GaugeValue, float64(stats.Memberships))
+}
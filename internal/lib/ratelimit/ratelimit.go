@@ -0,0 +1,223 @@
+// Package ratelimit implements token bucket rate limiting of clients.
+package ratelimit
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Limit is a token bucket refilled with Rate tokens per second and holding
+// at most Burst tokens. Every request takes one token.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Unlimited tells whether the limit lets all requests through.
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+// Policy holds the limits of routes. Routes without their own limit share
+// the bucket of Default.
+type Policy struct {
+	// Address limits all requests of a remote address, including ones
+	// with invalid credentials.
+	Address Limit
+	Default Limit
+	// Routes maps "METHOD /pattern", e.g. "POST /users/{id}/segments", to
+	// the limit of the route.
+	Routes map[string]Limit
+}
+
+// For returns the limit of the route and the name of its bucket.
+func (p Policy) For(method, pattern string) (Limit, string) {
+	route := method + " " + pattern
+	if limit, ok := p.Routes[route]; ok {
+		return limit, route
+	}
+	return p.Default, "*"
+}
+
+// Refill is the longest time a bucket of the policy takes to fill up.
+func (p Policy) Refill() time.Duration {
+	refill := p.Default.refill()
+	if r := p.Address.refill(); r > refill {
+		refill = r
+	}
+	for _, limit := range p.Routes {
+		if r := limit.refill(); r > refill {
+			refill = r
+		}
+	}
+	return refill
+}
+
+func (l Limit) refill() time.Duration {
+	if l.Unlimited() {
+		return 0
+	}
+	return seconds(float64(l.Burst) / l.Rate)
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size.
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until a token is available, zero if the
+	// request is allowed.
+	RetryAfter time.Duration
+}
+
+// Bucket is the state of a token bucket.
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// Full returns a full bucket of limit.
+func Full(limit Limit, now time.Time) Bucket {
+	return Bucket{Tokens: float64(limit.Burst), UpdatedAt: now}
+}
+
+// Take refills the bucket with tokens accrued since its last update and
+// takes one token if there is any.
+func Take(b Bucket, limit Limit, now time.Time) (Bucket, Result) {
+	elapsed := now.Sub(b.UpdatedAt).Seconds()
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	burst := float64(limit.Burst)
+	b.Tokens = math.Min(burst, b.Tokens+elapsed*limit.Rate)
+	b.UpdatedAt = now
+
+	res := Result{Limit: limit.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = seconds((1 - b.Tokens) / limit.Rate)
+	}
+
+	res.Remaining = int(b.Tokens)
+	res.Reset = seconds((burst - b.Tokens) / limit.Rate)
+
+	return b, res
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Limiter takes tokens from the buckets of clients.
+type Limiter interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// Sweeper is a limiter whose idle buckets are deleted by RunCleanup.
+type Sweeper interface {
+	// DeleteIdle deletes the buckets not updated for idle.
+	DeleteIdle(ctx context.Context, idle time.Duration) (int64, error)
+}
+
+// RunCleanup periodically deletes buckets not updated for idle until ctx
+// is done. A bucket idle for its refill time is full, so deleting it does
+// not change the limits.
+func RunCleanup(ctx context.Context, log *slog.Logger, sweeper Sweeper, idle, interval time.Duration) {
+	const op = "lib.ratelimit.RunCleanup"
+
+	log = log.With(
+		slog.String("op", op),
+	)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := sweeper.DeleteIdle(ctx, idle)
+			if err != nil {
+				log.Error("failed to delete idle rate limit buckets", slogger.Err(err))
+
+				continue
+			}
+
+			if deleted > 0 {
+				log.Debug("idle rate limit buckets deleted", slog.Int64("deleted", deleted))
+			}
+		}
+	}
+}
+
+// Memory is a limiter keeping buckets in process memory, so every instance
+// of the service limits clients on its own.
+type Memory struct {
+	mu      sync.Mutex
+	buckets map[string]Bucket
+	now     func() time.Time
+	// refill is the longest time a bucket seen so far takes to fill up.
+	refill time.Duration
+	takes  int
+}
+
+// cleanupEvery is the number of takes between removals of idle buckets.
+const cleanupEvery = 1024
+
+var _ Limiter = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]Bucket),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Take(_ context.Context, key string, limit Limit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = Full(limit, now)
+	}
+
+	b, res := Take(b, limit, now)
+	m.buckets[key] = b
+
+	if refill := limit.refill(); refill > m.refill {
+		m.refill = refill
+	}
+
+	m.takes++
+	if m.takes%cleanupEvery == 0 {
+		m.cleanup(now)
+	}
+
+	return res, nil
+}
+
+// cleanup forgets buckets that are full again by now, as they are
+// indistinguishable from new ones. It must be called with m.mu held.
+func (m *Memory) cleanup(now time.Time) {
+	cutoff := now.Add(-m.refill)
+	for key, b := range m.buckets {
+		if b.UpdatedAt.Before(cutoff) {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTake(t *testing.T) {
+	limit := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+
+	b := Full(limit, now)
+
+	var res Result
+	for i := 0; i < 3; i++ {
+		b, res = Take(b, limit, now)
+		require.True(t, res.Allowed)
+		require.Equal(t, 2-i, res.Remaining)
+	}
+
+	b, res = Take(b, limit, now)
+	require.False(t, res.Allowed)
+	require.Equal(t, 0, res.Remaining)
+	require.Equal(t, 500*time.Millisecond, res.RetryAfter)
+	require.Equal(t, 1500*time.Millisecond, res.Reset)
+
+	// Half a second later a single token is refilled.
+	b, res = Take(b, limit, now.Add(500*time.Millisecond))
+	require.True(t, res.Allowed)
+	require.Zero(t, res.RetryAfter)
+
+	// The bucket never holds more than Burst tokens.
+	_, res = Take(b, limit, now.Add(time.Hour))
+	require.True(t, res.Allowed)
+	require.Equal(t, 2, res.Remaining)
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Now()
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	limit := Limit{Rate: 1, Burst: 1}
+
+	res, err := m.Take(ctx, "a", limit)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+
+	res, err = m.Take(ctx, "a", limit)
+	require.NoError(t, err)
+	require.False(t, res.Allowed)
+	require.Equal(t, time.Second, res.RetryAfter)
+
+	// Buckets of other clients are independent.
+	res, err = m.Take(ctx, "b", limit)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+
+	now = now.Add(time.Second)
+
+	res, err = m.Take(ctx, "a", limit)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+}
+
+func TestPolicy(t *testing.T) {
+	p := Policy{
+		Default: Limit{Rate: 10, Burst: 20},
+		Routes:  map[string]Limit{"POST /users/{id}/segments": {Rate: 1, Burst: 2}},
+	}
+
+	limit, bucket := p.For("POST", "/users/{id}/segments")
+	require.Equal(t, Limit{Rate: 1, Burst: 2}, limit)
+	require.Equal(t, "POST /users/{id}/segments", bucket)
+
+	limit, bucket = p.For("GET", "/users/{id}/segments")
+	require.Equal(t, p.Default, limit)
+	require.Equal(t, "*", bucket)
+
+	require.Equal(t, 2*time.Second, p.Refill())
+
+	p.Address = Limit{Rate: 1, Burst: 5}
+	require.Equal(t, 5*time.Second, p.Refill())
+}
@@ -0,0 +1,17 @@
+package readiness
+
+import "sync/atomic"
+
+// Flag tells whether the service is ready to accept traffic. The service
+// becomes ready once started and not ready as soon as shutdown begins.
+type Flag struct {
+	ready atomic.Bool
+}
+
+func (f *Flag) SetReady(ready bool) {
+	f.ready.Store(ready)
+}
+
+func (f *Flag) Ready() bool {
+	return f.ready.Load()
+}
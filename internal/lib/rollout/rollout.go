@@ -0,0 +1,28 @@
+package rollout
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"strconv"
+)
+
+// Selected reports whether the user falls into the given percent of users
+// automatically enrolled into the segment. The choice depends only on the
+// user id and the segment id, so it is stable across recomputations and
+// renames of the segment.
+//
+// The bucket of the user is the first 4 bytes of the MD5 of "user:segment"
+// ids as a big endian number modulo 100, which Postgres computes with md5()
+// as well.
+func Selected(userID, segmentID int64, percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	if percent >= 100 {
+		return true
+	}
+
+	sum := md5.Sum([]byte(strconv.FormatInt(userID, 10) + ":" + strconv.FormatInt(segmentID, 10)))
+
+	return int(binary.BigEndian.Uint32(sum[:4])%100) < percent
+}
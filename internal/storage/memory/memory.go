@@ -0,0 +1,993 @@
+package memory
+
+import (
+	"avito-internship/internal/lib/rollout"
+	"avito-internship/internal/storage"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type segment struct {
+	id          int64
+	name        string
+	autoPercent int
+	meta        storage.SegmentMeta
+	createdBy   string
+	createdAt   time.Time
+	updatedAt   time.Time
+	deletedAt   time.Time
+	// archived are the memberships the segment had when it was deleted.
+	archived map[int64]time.Time
+}
+
+// info returns the segment without its member count. Tags are copied, so
+// that callers cannot change the stored segment.
+func (s *segment) info() storage.Segment {
+	meta := s.meta
+	meta.Tags = append([]string(nil), s.meta.Tags...)
+
+	return storage.Segment{
+		ID:          s.id,
+		Name:        s.name,
+		AutoPercent: s.autoPercent,
+		SegmentMeta: meta,
+		CreatedBy:   s.createdBy,
+		CreatedAt:   s.createdAt,
+		UpdatedAt:   s.updatedAt,
+	}
+}
+
+// Memory is a storage kept in process memory. It is meant for demos and
+// tests and loses all data on restart.
+type Memory struct {
+	mu sync.RWMutex
+
+	lastSegmentID int64
+	segments      map[string]*segment
+	// users maps user id to its memberships: segment name to expiry time,
+	// zero time for memberships without expiry.
+	users map[int64]map[string]time.Time
+	// aliases maps former names of renamed segments to the segments.
+	aliases map[string]alias
+	// deleted are segments which can be restored until purged.
+	deleted []*segment
+	history []storage.HistoryRecord
+	audit   []storage.AuditRecord
+
+	lastAPIKeyID int64
+	apiKeys      map[int64]*apiKey
+}
+
+type alias struct {
+	segment   *segment
+	expiresAt time.Time
+}
+
+type apiKey struct {
+	key     storage.APIKey
+	hash    string
+	revoked bool
+}
+
+var _ storage.Store = (*Memory)(nil)
+
+func New() *Memory {
+	return &Memory{
+		segments: make(map[string]*segment),
+		users:    make(map[int64]map[string]time.Time),
+		aliases:  make(map[string]alias),
+		apiKeys:  make(map[int64]*apiKey),
+	}
+}
+
+func (m *Memory) CreateSegment(ctx context.Context, segmentToCreate string, autoPercent int, meta storage.SegmentMeta) (int64, error) {
+	const op = "storage.memory.CreateSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.nameTaken(segmentToCreate, nil, now) {
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+	}
+
+	m.lastSegmentID++
+	meta.Tags = append([]string(nil), meta.Tags...)
+	m.segments[segmentToCreate] = &segment{
+		id:          m.lastSegmentID,
+		name:        segmentToCreate,
+		autoPercent: autoPercent,
+		meta:        meta,
+		createdBy:   storage.ActorFromContext(ctx),
+		createdAt:   now,
+		updatedAt:   now,
+	}
+
+	m.writeAudit(segmentToCreate, storage.AuditCreate, storage.ActorFromContext(ctx), now)
+	for user_id, memberships := range m.users {
+		if rollout.Selected(user_id, m.lastSegmentID, autoPercent) {
+			memberships[segmentToCreate] = time.Time{}
+			m.writeHistory(user_id, []string{segmentToCreate}, storage.OperationAdd, storage.ActorFromContext(ctx), now)
+		}
+	}
+
+	return m.lastSegmentID, nil
+}
+
+func (m *Memory) GetSegment(ctx context.Context, slug string) (storage.Segment, error) {
+	const op = "storage.memory.GetSegment"
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	seg, ok := m.resolve(slug, now)
+	if !ok {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	return m.withAliases(seg, now), nil
+}
+
+func (m *Memory) UpdateSegment(ctx context.Context, slug string, meta storage.SegmentMeta) (storage.Segment, error) {
+	const op = "storage.memory.UpdateSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	seg, ok := m.resolve(slug, now)
+	if !ok {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	meta.Tags = append([]string(nil), meta.Tags...)
+	seg.meta = meta
+	seg.updatedAt = now
+
+	m.writeAudit(seg.name, storage.AuditUpdate, storage.ActorFromContext(ctx), now)
+
+	return m.withAliases(seg, now), nil
+}
+
+func (m *Memory) RenameSegment(ctx context.Context, slug, name string, aliasExpiresAt time.Time) (storage.Segment, error) {
+	const op = "storage.memory.RenameSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	seg, ok := m.resolve(slug, now)
+	if !ok {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	if seg.name == name {
+		return m.withAliases(seg, now), nil
+	}
+
+	if m.nameTaken(name, seg, now) {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+	}
+
+	previous := seg.name
+	delete(m.segments, previous)
+	seg.name = name
+	seg.updatedAt = now
+	m.segments[name] = seg
+
+	for _, memberships := range m.users {
+		if expiresAt, ok := memberships[previous]; ok {
+			delete(memberships, previous)
+			memberships[name] = expiresAt
+		}
+	}
+
+	// The new name is no longer an alias, e.g. when a segment gets its
+	// former name back. Expired aliases are cleaned up on the way.
+	for former, a := range m.aliases {
+		if !a.expiresAt.After(now) {
+			delete(m.aliases, former)
+		}
+	}
+	delete(m.aliases, name)
+	m.aliases[previous] = alias{segment: seg, expiresAt: aliasExpiresAt}
+
+	m.audit = append(m.audit, storage.AuditRecord{
+		Segment:      name,
+		Action:       storage.AuditRename,
+		PreviousName: previous,
+		Actor:        storage.ActorFromContext(ctx),
+		CreatedAt:    now,
+	})
+
+	return m.withAliases(seg, now), nil
+}
+
+// resolve returns the segment with the name or the not expired alias slug.
+// Aliases of deleted segments are kept for RestoreSegment but do not resolve.
+func (m *Memory) resolve(slug string, now time.Time) (*segment, bool) {
+	if seg, ok := m.segments[slug]; ok {
+		return seg, true
+	}
+
+	a, ok := m.aliases[slug]
+	if !ok || !a.expiresAt.After(now) || !a.segment.deletedAt.IsZero() {
+		return nil, false
+	}
+
+	return a.segment, true
+}
+
+// resolveNames must be called with m.mu held. It returns the names of the
+// segments named by slugs, as in resolve, in the same order.
+func (m *Memory) resolveNames(slugs []string, now time.Time) ([]string, error) {
+	names := make([]string, 0, len(slugs))
+	for _, slug := range slugs {
+		seg, ok := m.resolve(slug, now)
+		if !ok {
+			return nil, storage.ErrSegmentNotFound
+		}
+		names = append(names, seg.name)
+	}
+
+	return names, nil
+}
+
+// nameTaken tells whether name is used by a segment or by a not expired
+// alias of a not deleted segment other than seg.
+func (m *Memory) nameTaken(name string, seg *segment, now time.Time) bool {
+	if _, ok := m.segments[name]; ok {
+		return true
+	}
+
+	a, ok := m.aliases[name]
+	return ok && a.segment != seg && a.expiresAt.After(now) && a.segment.deletedAt.IsZero()
+}
+
+func (m *Memory) SegmentsByAlias(ctx context.Context, slugs []string) (map[string]storage.Segment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	segments := make(map[string]storage.Segment)
+	for _, slug := range slugs {
+		if _, ok := m.segments[slug]; ok {
+			continue
+		}
+		if seg, ok := m.resolve(slug, now); ok {
+			segments[slug] = m.withAliases(seg, now)
+		}
+	}
+
+	return segments, nil
+}
+
+func (m *Memory) withAliases(seg *segment, now time.Time) storage.Segment {
+	info := seg.info()
+	for name, a := range m.aliases {
+		if a.segment == seg && a.expiresAt.After(now) {
+			info.Aliases = append(info.Aliases, storage.SegmentAlias{Name: name, ExpiresAt: a.expiresAt})
+		}
+	}
+
+	sort.Slice(info.Aliases, func(i, j int) bool {
+		a, b := info.Aliases[i], info.Aliases[j]
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+		return a.Name < b.Name
+	})
+
+	return info
+}
+
+// DeleteSegment keeps the aliases of the segment, so that it can be
+// restored by them.
+func (m *Memory) DeleteSegment(ctx context.Context, slug string) (int64, error) {
+	const op = "storage.memory.DeleteSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	seg, ok := m.resolve(slug, now)
+	if !ok {
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	name := seg.name
+	seg.archived = make(map[int64]time.Time)
+	for user_id, memberships := range m.users {
+		if expiresAt, ok := memberships[name]; ok {
+			seg.archived[user_id] = expiresAt
+			delete(memberships, name)
+			m.writeHistory(user_id, []string{name}, storage.OperationRemove, storage.ActorFromContext(ctx), now)
+		}
+	}
+
+	delete(m.segments, name)
+	seg.deletedAt = now
+	m.deleted = append(m.deleted, seg)
+	m.writeAudit(name, storage.AuditDelete, storage.ActorFromContext(ctx), now)
+
+	return seg.id, nil
+}
+
+func (m *Memory) RestoreSegment(ctx context.Context, slug string, deletedAfter time.Time) (storage.Segment, error) {
+	const op = "storage.memory.RestoreSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	i := m.lastDeleted(func(seg *segment) bool { return seg.name == slug }, deletedAfter)
+	if a, ok := m.aliases[slug]; i < 0 && ok && a.expiresAt.After(now) {
+		i = m.lastDeleted(func(seg *segment) bool { return seg == a.segment }, deletedAfter)
+	}
+	if i < 0 {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	seg := m.deleted[i]
+	name := seg.name
+	if m.nameTaken(name, seg, now) {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+	}
+
+	m.deleted = append(m.deleted[:i], m.deleted[i+1:]...)
+	m.segments[name] = seg
+	seg.deletedAt = time.Time{}
+	seg.updatedAt = now
+
+	for user_id, expiresAt := range seg.archived {
+		if !expiresAt.IsZero() && !expiresAt.After(now) {
+			continue
+		}
+		m.users[user_id][name] = expiresAt
+		m.writeHistory(user_id, []string{name}, storage.OperationAdd, storage.ActorFromContext(ctx), now)
+	}
+	seg.archived = nil
+
+	// Aliases which became names of other segments no longer resolve.
+	for alias, a := range m.aliases {
+		if _, ok := m.segments[alias]; ok && a.segment == seg {
+			delete(m.aliases, alias)
+		}
+	}
+
+	m.writeAudit(name, storage.AuditRestore, storage.ActorFromContext(ctx), now)
+
+	return m.withAliases(seg, now), nil
+}
+
+// lastDeleted must be called with m.mu held. It returns the index of the
+// latest segment deleted after deletedAfter and matching match, or -1.
+func (m *Memory) lastDeleted(match func(*segment) bool, deletedAfter time.Time) int {
+	// Segments are deleted in order, so the latest one is the last.
+	for i := len(m.deleted) - 1; i >= 0; i-- {
+		if match(m.deleted[i]) && m.deleted[i].deletedAt.After(deletedAfter) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (m *Memory) PurgeSegments(ctx context.Context, deletedBefore time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	kept := m.deleted[:0]
+	var purged int64
+	for _, seg := range m.deleted {
+		if seg.deletedAt.After(deletedBefore) {
+			kept = append(kept, seg)
+			continue
+		}
+		m.writeAudit(seg.name, storage.AuditPurge, storage.ActorFromContext(ctx), now)
+		for alias, a := range m.aliases {
+			if a.segment == seg {
+				delete(m.aliases, alias)
+			}
+		}
+		purged++
+	}
+	m.deleted = kept
+
+	return purged, nil
+}
+
+func (m *Memory) ListSegments(ctx context.Context, filter storage.SegmentFilter) ([]storage.Segment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// less orders segments as requested, ties are broken by name.
+	less := func(a, b storage.Segment) bool {
+		if filter.Sort == storage.SortByCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt) != filter.Desc
+		}
+		return (a.Name < b.Name) != filter.Desc
+	}
+
+	now := time.Now()
+	segments := []storage.Segment{}
+	for name, seg := range m.segments {
+		if !strings.HasPrefix(name, filter.Prefix) || !strings.Contains(name, filter.Contains) {
+			continue
+		}
+		if filter.Owner != "" && seg.meta.Owner != filter.Owner {
+			continue
+		}
+		if filter.Tag != "" && !hasTag(seg.meta.Tags, filter.Tag) {
+			continue
+		}
+
+		segment := seg.info()
+		if filter.After != nil && !less(*filter.After, segment) {
+			continue
+		}
+
+		if filter.WithMembers {
+			for _, memberships := range m.users {
+				if expiresAt, ok := memberships[name]; ok && (expiresAt.IsZero() || expiresAt.After(now)) {
+					segment.Members++
+				}
+			}
+		}
+
+		segments = append(segments, segment)
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return less(segments[i], segments[j])
+	})
+
+	if len(segments) > filter.Limit {
+		segments = segments[:filter.Limit]
+	}
+
+	return segments, nil
+}
+
+func (m *Memory) CreateUser(ctx context.Context, user_id int64, segments []string) error {
+	const op = "storage.memory.CreateUser"
+
+	if err := validateSegments(segments); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[user_id]; ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+	}
+
+	names, err := m.resolveNames(segments, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.createUser(ctx, user_id, names)
+
+	return nil
+}
+
+// createUser must be called with m.mu held. segments are segment names,
+// possibly repeated. The user is also enrolled into segments with
+// automatic enrollment.
+func (m *Memory) createUser(ctx context.Context, user_id int64, segments []string) {
+	memberships := make(map[string]time.Time, len(segments))
+	added := make([]string, 0, len(segments))
+	for _, name := range segments {
+		if _, ok := memberships[name]; ok {
+			continue
+		}
+		memberships[name] = time.Time{}
+		added = append(added, name)
+	}
+	for name, seg := range m.segments {
+		if _, ok := memberships[name]; ok {
+			continue
+		}
+		if rollout.Selected(user_id, seg.id, seg.autoPercent) {
+			memberships[name] = time.Time{}
+			added = append(added, name)
+		}
+	}
+
+	m.users[user_id] = memberships
+	m.writeHistory(user_id, added, storage.OperationAdd, storage.ActorFromContext(ctx), time.Now())
+}
+
+func (m *Memory) ImportUsers(ctx context.Context, users []storage.ImportedUser, dryRun bool) (map[int]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failed := make(map[int]error)
+	seen := make(map[int64]bool, len(users))
+	names := make(map[int][]string, len(users))
+
+	for i, user := range users {
+		segments, err := m.checkImportedUser(user, seen)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		seen[user.UserID] = true
+		names[i] = segments
+	}
+
+	if dryRun {
+		return failed, nil
+	}
+
+	for i, user := range users {
+		if _, ok := failed[i]; !ok {
+			m.createUser(ctx, user.UserID, names[i])
+		}
+	}
+
+	return failed, nil
+}
+
+// checkImportedUser must be called with m.mu held. seen are the users
+// already imported by the batch. It returns the names of the user segments.
+func (m *Memory) checkImportedUser(user storage.ImportedUser, seen map[int64]bool) ([]string, error) {
+	if _, ok := m.users[user.UserID]; ok || seen[user.UserID] {
+		return nil, storage.ErrUserExists
+	}
+
+	// A segment named both by its name and by an alias is a duplicate.
+	names := make([]string, 0, len(user.Segments))
+	unique := make(map[string]bool, len(user.Segments))
+	now := time.Now()
+	for _, slug := range user.Segments {
+		seg, ok := m.resolve(slug, now)
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", storage.ErrSegmentNotFound, slug)
+		}
+
+		if unique[seg.name] {
+			return nil, storage.ErrDuplicateSegments
+		}
+		unique[seg.name] = true
+		names = append(names, seg.name)
+	}
+
+	return names, nil
+}
+
+func (m *Memory) UserExists(ctx context.Context, user_id int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.users[user_id]
+
+	return ok, nil
+}
+
+func (m *Memory) AddUserToSegment(ctx context.Context, user_id int64, segments []string, expires map[string]time.Time) error {
+	const op = "storage.memory.AddUserToSegment"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	memberships, ok := m.users[user_id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	names, err := m.resolveNames(segments, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	resolved := make(map[string]time.Time, len(expires))
+	for i, slug := range segments {
+		if expiresAt, ok := expires[slug]; ok {
+			resolved[names[i]] = expiresAt
+		}
+	}
+
+	m.addSegments(ctx, user_id, memberships, names, resolved, true)
+
+	return nil
+}
+
+func (m *Memory) RemoveSegmentsFromUser(ctx context.Context, user_id int64, segments []string) error {
+	const op = "storage.memory.RemoveSegmentsFromUser"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	memberships, ok := m.users[user_id]
+	if !ok {
+		return fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	names, err := m.resolveNames(segments, time.Now())
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.removeSegments(ctx, user_id, memberships, names)
+
+	return nil
+}
+
+func (m *Memory) AddSegmentMembers(ctx context.Context, segmentID int64, users []int64, createMissing bool) (storage.MembersResult, error) {
+	const op = "storage.memory.AddSegmentMembers"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seg, ok := m.segmentByID(segmentID)
+	if !ok {
+		return storage.MembersResult{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	var res storage.MembersResult
+	for i, user_id := range users {
+		memberships, ok := m.users[user_id]
+		switch {
+		case !ok && createMissing:
+			m.createUser(ctx, user_id, []string{seg.name})
+			res.Created++
+			res.Changed++
+		case !ok:
+			res.Unknown = append(res.Unknown, i)
+		default:
+			if _, ok := memberships[seg.name]; ok {
+				res.Unchanged++
+				continue
+			}
+			res.Changed++
+			m.addSegments(ctx, user_id, memberships, []string{seg.name}, nil, false)
+		}
+	}
+
+	return res, nil
+}
+
+func (m *Memory) RemoveSegmentMembers(ctx context.Context, segmentID int64, users []int64) (storage.MembersResult, error) {
+	const op = "storage.memory.RemoveSegmentMembers"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seg, ok := m.segmentByID(segmentID)
+	if !ok {
+		return storage.MembersResult{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+
+	var res storage.MembersResult
+	for i, user_id := range users {
+		memberships, ok := m.users[user_id]
+		if !ok {
+			res.Unknown = append(res.Unknown, i)
+			continue
+		}
+
+		if _, ok := memberships[seg.name]; ok {
+			res.Changed++
+		} else {
+			res.Unchanged++
+		}
+		m.removeSegments(ctx, user_id, memberships, []string{seg.name})
+	}
+
+	return res, nil
+}
+
+// segmentByID must be called with m.mu held.
+func (m *Memory) segmentByID(id int64) (*segment, bool) {
+	for _, seg := range m.segments {
+		if seg.id == id {
+			return seg, true
+		}
+	}
+
+	return nil, false
+}
+
+func (m *Memory) UpdateUserSegments(ctx context.Context, user_id int64, add, remove []string) ([]string, error) {
+	const op = "storage.memory.UpdateUserSegments"
+
+	if err := storage.CheckSegmentsConflict(add, remove); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	memberships, ok := m.users[user_id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	// Check everything before changing anything so the update is atomic.
+	now := time.Now()
+	added, err := m.resolveNames(add, now)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	removed, err := m.resolveNames(remove, now)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	// A segment may be added by its name and removed by an alias.
+	if err := storage.CheckSegmentsConflict(added, removed); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	m.addSegments(ctx, user_id, memberships, added, nil, false)
+	m.removeSegments(ctx, user_id, memberships, removed)
+
+	return activeSegments(memberships, time.Now()), nil
+}
+
+func (m *Memory) ShowActiveSegmentUser(ctx context.Context, user_id int64) ([]string, error) {
+	const op = "storage.memory.ShowActiveSegmentUser"
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	memberships, ok := m.users[user_id]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	return activeSegments(memberships, time.Now()), nil
+}
+
+func (m *Memory) RemoveExpiredSegments(ctx context.Context, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed int64
+	for user_id, memberships := range m.users {
+		var expired []string
+		for name, expiresAt := range memberships {
+			if !expiresAt.IsZero() && !expiresAt.After(now) {
+				delete(memberships, name)
+				expired = append(expired, name)
+			}
+		}
+
+		sort.Strings(expired)
+		m.writeHistory(user_id, expired, storage.OperationExpire, storage.ActorFromContext(ctx), now)
+		removed += int64(len(expired))
+	}
+
+	return removed, nil
+}
+
+// History calls fn after releasing the lock, so that a slow consumer does
+// not block changes.
+func (m *Memory) History(ctx context.Context, from, to time.Time, fn func(storage.HistoryRecord) error) error {
+	m.mu.RLock()
+
+	var records []storage.HistoryRecord
+	for _, record := range m.history {
+		if !record.CreatedAt.Before(from) && record.CreatedAt.Before(to) {
+			records = append(records, record)
+		}
+	}
+
+	m.mu.RUnlock()
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	for _, record := range records {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) SegmentAudit(ctx context.Context, from, to time.Time) ([]storage.AuditRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var records []storage.AuditRecord
+	for _, record := range m.audit {
+		if !record.CreatedAt.Before(from) && record.CreatedAt.Before(to) {
+			records = append(records, record)
+		}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	return records, nil
+}
+
+// addSegments must be called with m.mu held.
+func (m *Memory) addSegments(ctx context.Context, user_id int64, memberships map[string]time.Time, segments []string, expires map[string]time.Time, replaceExpiry bool) {
+	var added []string
+	for _, name := range segments {
+		if _, ok := memberships[name]; !ok {
+			added = append(added, name)
+		} else if !replaceExpiry {
+			continue
+		}
+		memberships[name] = expires[name]
+	}
+
+	m.writeHistory(user_id, added, storage.OperationAdd, storage.ActorFromContext(ctx), time.Now())
+}
+
+// removeSegments must be called with m.mu held.
+func (m *Memory) removeSegments(ctx context.Context, user_id int64, memberships map[string]time.Time, segments []string) {
+	var removed []string
+	for _, name := range segments {
+		if _, ok := memberships[name]; ok {
+			delete(memberships, name)
+			removed = append(removed, name)
+		}
+	}
+
+	m.writeHistory(user_id, removed, storage.OperationRemove, storage.ActorFromContext(ctx), time.Now())
+}
+
+func activeSegments(memberships map[string]time.Time, now time.Time) []string {
+	var segments []string
+	for name, expiresAt := range memberships {
+		if expiresAt.IsZero() || expiresAt.After(now) {
+			segments = append(segments, name)
+		}
+	}
+	sort.Strings(segments)
+
+	return segments
+}
+
+func (m *Memory) Stats(ctx context.Context) (storage.Stats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	stats := storage.Stats{Segments: int64(len(m.segments))}
+
+	now := time.Now()
+	for _, memberships := range m.users {
+		stats.Memberships += int64(len(activeSegments(memberships, now)))
+	}
+
+	return stats, nil
+}
+
+func (m *Memory) CreateAPIKey(ctx context.Context, name string, hash []byte, scopes []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastAPIKeyID++
+	m.apiKeys[m.lastAPIKeyID] = &apiKey{
+		key: storage.APIKey{
+			ID:        m.lastAPIKeyID,
+			Name:      name,
+			Scopes:    append([]string(nil), scopes...),
+			CreatedAt: time.Now(),
+		},
+		hash: string(hash),
+	}
+
+	return m.lastAPIKeyID, nil
+}
+
+func (m *Memory) APIKeyByHash(ctx context.Context, hash []byte) (storage.APIKey, error) {
+	const op = "storage.memory.APIKeyByHash"
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.apiKeys {
+		if !k.revoked && k.hash == string(hash) {
+			key := k.key
+			key.Scopes = append([]string(nil), k.key.Scopes...)
+			return key, nil
+		}
+	}
+
+	return storage.APIKey{}, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+}
+
+func (m *Memory) RotateAPIKey(ctx context.Context, id int64, hash []byte) error {
+	const op = "storage.memory.RotateAPIKey"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok || k.revoked {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+	k.hash = string(hash)
+
+	return nil
+}
+
+func (m *Memory) RevokeAPIKey(ctx context.Context, id int64) error {
+	const op = "storage.memory.RevokeAPIKey"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.apiKeys[id]
+	if !ok || k.revoked {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+	k.revoked = true
+
+	return nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// writeHistory must be called with m.mu held.
+func (m *Memory) writeHistory(user_id int64, segments []string, operation, actor string, at time.Time) {
+	for _, name := range segments {
+		m.history = append(m.history, storage.HistoryRecord{
+			UserID:    user_id,
+			Segment:   name,
+			Operation: operation,
+			Actor:     actor,
+			CreatedAt: at,
+		})
+	}
+}
+
+// writeAudit must be called with m.mu held.
+func (m *Memory) writeAudit(segment, action, actor string, at time.Time) {
+	m.audit = append(m.audit, storage.AuditRecord{
+		Segment:   segment,
+		Action:    action,
+		Actor:     actor,
+		CreatedAt: at,
+	})
+}
+
+func validateSegments(segments []string) error {
+	// Check that the list of segments is not empty.
+	if len(segments) == 0 {
+		return storage.ErrNoSegments
+	}
+
+	// Check that the list of segments does not contain any duplicates.
+	uniqueSegments := make(map[string]bool)
+	for _, segment := range segments {
+		if uniqueSegments[segment] {
+			return storage.ErrDuplicateSegments
+		}
+		uniqueSegments[segment] = true
+	}
+
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+package memory_test
+
+import (
+	"avito-internship/internal/storage"
+	"avito-internship/internal/storage/memory"
+	"avito-internship/internal/storage/storagetest"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Store {
+		return memory.New()
+	})
+}
@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+func (p *Postgres) CreateAPIKey(ctx context.Context, name string, hash []byte, scopes []string) (_ int64, err error) {
+	const op = "storage.postgres.api_keys_table.CreateAPIKey"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	var id int64
+	err = p.db.QueryRowContext(ctx,
+		"INSERT INTO api_keys(name, key_hash, scopes) VALUES($1, $2, $3) RETURNING id",
+		name,
+		hash,
+		pq.StringArray(scopes),
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return id, nil
+}
+
+func (p *Postgres) APIKeyByHash(ctx context.Context, hash []byte) (_ storage.APIKey, err error) {
+	const op = "storage.postgres.api_keys_table.APIKeyByHash"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	var (
+		key    storage.APIKey
+		scopes pq.StringArray
+	)
+	err = p.db.QueryRowContext(ctx,
+		"SELECT id, name, scopes, created_at FROM api_keys WHERE key_hash = $1 AND revoked_at IS NULL",
+		hash,
+	).Scan(&key.ID, &key.Name, &scopes, &key.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.APIKey{}, fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+	if err != nil {
+		return storage.APIKey{}, fmt.Errorf("%s: %w", op, err)
+	}
+	key.Scopes = scopes
+
+	return key, nil
+}
+
+func (p *Postgres) RotateAPIKey(ctx context.Context, id int64, hash []byte) (err error) {
+	const op = "storage.postgres.api_keys_table.RotateAPIKey"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := p.db.ExecContext(ctx,
+		"UPDATE api_keys SET key_hash = $2, rotated_at = now() WHERE id = $1 AND revoked_at IS NULL",
+		id,
+		hash,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return checkKeyAffected(op, res)
+}
+
+func (p *Postgres) RevokeAPIKey(ctx context.Context, id int64) (err error) {
+	const op = "storage.postgres.api_keys_table.RevokeAPIKey"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := p.db.ExecContext(ctx,
+		"UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL", id)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return checkKeyAffected(op, res)
+}
+
+// checkKeyAffected returns storage.ErrAPIKeyNotFound if res affected no rows.
+func checkKeyAffected(op string, res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if affected == 0 {
+		return fmt.Errorf("%s: %w", op, storage.ErrAPIKeyNotFound)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// writeHistory records membership changes of a user inside the given transaction.
+func writeHistory(ctx context.Context, tx *sql.Tx, user_id int64, segments []string, operation string) error {
+	stmt, err := tx.PrepareContext(ctx,
+		"INSERT INTO users_segments_history(user_id, segment, operation, actor) VALUES($1, $2, $3, $4)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	actor := storage.ActorFromContext(ctx)
+	for _, segment := range segments {
+		if _, err := stmt.ExecContext(ctx, user_id, segment, operation, actor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// History calls fn for membership changes made in [from, to) ordered by
+// time as the rows are read.
+func (p *Postgres) History(ctx context.Context, from, to time.Time, fn func(storage.HistoryRecord) error) (err error) {
+	const op = "storage.postgres.history_table.History"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT user_id, segment, operation, actor, created_at
+		FROM users_segments_history
+		WHERE created_at >= $1 AND created_at < $2
+		ORDER BY created_at, id`, from, to)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record storage.HistoryRecord
+		if err := rows.Scan(&record.UserID, &record.Segment, &record.Operation, &record.Actor, &record.CreatedAt); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		if err := fn(record); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package postgres
+
+import (
+	"avito-internship/internal/lib/idempotency"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// IdempotencyStore returns a store of idempotency keys shared by all
+// instances of the service.
+func (p *Postgres) IdempotencyStore() idempotency.Store {
+	return &idempotencyStore{p: p}
+}
+
+type idempotencyStore struct {
+	p *Postgres
+}
+
+func (s *idempotencyStore) Reserve(ctx context.Context, key, token string, fingerprint []byte, now, expiresAt time.Time) (_ idempotency.Record, _ bool, err error) {
+	const op = "storage.postgres.idempotency_keys_table.Reserve"
+
+	ctx, o := s.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	// The existing record may expire or be released between the statements,
+	// then the key is reserved on the second attempt.
+	for attempt := 0; attempt < 2; attempt++ {
+		var reserved bool
+		err := s.p.db.QueryRowContext(ctx, `
+			INSERT INTO idempotency_keys AS k(key, fingerprint, expires_at, token) VALUES($1, $2, $4, $5)
+			ON CONFLICT (key) DO UPDATE SET
+				fingerprint = EXCLUDED.fingerprint,
+				token = EXCLUDED.token,
+				status = 0,
+				content_type = '',
+				body = NULL,
+				expires_at = EXCLUDED.expires_at
+			WHERE k.expires_at <= $3
+			RETURNING true`,
+			key,
+			fingerprint,
+			now,
+			expiresAt,
+			token,
+		).Scan(&reserved)
+		if err == nil {
+			return idempotency.Record{}, true, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+		}
+
+		var rec idempotency.Record
+		err = s.p.db.QueryRowContext(ctx, `
+			SELECT fingerprint, status, content_type, body, expires_at
+			FROM idempotency_keys WHERE key = $1`, key,
+		).Scan(&rec.Fingerprint, &rec.Status, &rec.ContentType, &rec.Body, &rec.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return idempotency.Record{}, false, fmt.Errorf("%s: %w", op, err)
+		}
+
+		return rec, false, nil
+	}
+
+	return idempotency.Record{}, false, fmt.Errorf("%s: key %s changed concurrently", op, key)
+}
+
+func (s *idempotencyStore) Complete(ctx context.Context, key, token string, status int, contentType string, body []byte, expiresAt time.Time) (err error) {
+	const op = "storage.postgres.idempotency_keys_table.Complete"
+
+	ctx, o := s.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := s.p.db.ExecContext(ctx, `
+		UPDATE idempotency_keys SET status = $3, content_type = $4, body = $5, expires_at = $6
+		WHERE key = $1 AND token = $2 AND status = 0`,
+		key,
+		token,
+		status,
+		contentType,
+		body,
+		expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	if updated == 0 {
+		return fmt.Errorf("%s: %w", op, idempotency.ErrNotReserved)
+	}
+
+	return nil
+}
+
+func (s *idempotencyStore) Release(ctx context.Context, key, token string) (err error) {
+	const op = "storage.postgres.idempotency_keys_table.Release"
+
+	ctx, o := s.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	_, err = s.p.db.ExecContext(ctx,
+		"DELETE FROM idempotency_keys WHERE key = $1 AND token = $2 AND status = 0", key, token)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func (s *idempotencyStore) DeleteExpired(ctx context.Context, now time.Time) (_ int64, err error) {
+	const op = "storage.postgres.idempotency_keys_table.DeleteExpired"
+
+	ctx, o := s.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := s.p.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deleted, nil
+}
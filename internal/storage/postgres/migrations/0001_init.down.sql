@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS users_segments_history;
+DROP TABLE IF EXISTS user_segments;
+DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS segments;
@@ -0,0 +1,66 @@
+-- Earlier releases created segments and users_segments_history at startup,
+-- so those tables are adopted if they already exist. Their users table kept
+-- the segments of a user in an array, it is moved into user_segments below.
+ALTER TABLE IF EXISTS users RENAME TO users_legacy;
+
+CREATE TABLE IF NOT EXISTS segments(
+	id SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+ALTER TABLE segments ADD COLUMN IF NOT EXISTS
+	auto_percent INTEGER NOT NULL DEFAULT 0 CHECK (auto_percent BETWEEN 0 AND 100);
+
+CREATE TABLE users(
+	id BIGINT PRIMARY KEY
+);
+
+CREATE TABLE user_segments(
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	segment_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ,
+	PRIMARY KEY (user_id, segment_id)
+);
+
+CREATE INDEX user_segments_segment_id_idx ON user_segments(segment_id);
+CREATE INDEX user_segments_expires_at_idx ON user_segments(expires_at)
+	WHERE expires_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS users_segments_history(
+	id BIGSERIAL PRIMARY KEY,
+	user_id BIGINT NOT NULL,
+	segment TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS users_segments_history_created_at_idx
+	ON users_segments_history(created_at);
+
+-- Memberships and their expiry from users_segments_ttl now live in
+-- user_segments. Expiry of segments a user is no longer in is dropped.
+DO $$
+BEGIN
+	IF to_regclass('users_legacy') IS NOT NULL THEN
+		INSERT INTO users(id) SELECT id FROM users_legacy;
+
+		INSERT INTO user_segments(user_id, segment_id)
+		SELECT DISTINCT u.id, s.id
+		FROM users_legacy u
+		CROSS JOIN LATERAL unnest(u.segments) AS m(name)
+		JOIN segments s ON s.name = m.name;
+
+		DROP TABLE users_legacy;
+	END IF;
+
+	IF to_regclass('users_segments_ttl') IS NOT NULL THEN
+		UPDATE user_segments us
+		SET expires_at = t.expires_at
+		FROM users_segments_ttl t
+		JOIN segments s ON s.name = t.segment
+		WHERE us.user_id = t.user_id AND us.segment_id = s.id;
+
+		DROP TABLE users_segments_ttl;
+	END IF;
+END
+$$;
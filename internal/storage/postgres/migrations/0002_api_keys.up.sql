@@ -0,0 +1,10 @@
+-- Keys are stored as SHA-256 hashes, the plain key is shown only once.
+CREATE TABLE api_keys(
+	id BIGSERIAL PRIMARY KEY,
+	name TEXT NOT NULL,
+	key_hash BYTEA NOT NULL UNIQUE,
+	scopes TEXT[] NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	rotated_at TIMESTAMPTZ,
+	revoked_at TIMESTAMPTZ
+);
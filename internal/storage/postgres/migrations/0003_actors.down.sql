@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS segment_audit;
+
+ALTER TABLE users_segments_history DROP COLUMN IF EXISTS actor;
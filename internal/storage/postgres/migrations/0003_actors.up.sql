@@ -0,0 +1,12 @@
+-- Changes made by the service itself, e.g. expiry, have an empty actor.
+ALTER TABLE users_segments_history ADD COLUMN actor TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE segment_audit(
+	id BIGSERIAL PRIMARY KEY,
+	segment TEXT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX segment_audit_created_at_idx ON segment_audit(created_at);
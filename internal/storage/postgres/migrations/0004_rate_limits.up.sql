@@ -0,0 +1,6 @@
+-- Token buckets shared by all instances of the service.
+CREATE TABLE rate_limits(
+	key TEXT PRIMARY KEY,
+	tokens DOUBLE PRECISION NOT NULL,
+	updated_at TIMESTAMPTZ NOT NULL
+);
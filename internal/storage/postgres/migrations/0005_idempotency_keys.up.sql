@@ -0,0 +1,12 @@
+-- Responses of requests made with an Idempotency-Key. Pending requests
+-- have status 0.
+CREATE TABLE idempotency_keys(
+	key TEXT PRIMARY KEY,
+	fingerprint BYTEA NOT NULL,
+	status INTEGER NOT NULL DEFAULT 0,
+	content_type TEXT NOT NULL DEFAULT '',
+	body BYTEA,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys(expires_at);
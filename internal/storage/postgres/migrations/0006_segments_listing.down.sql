@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS segments_created_at_idx;
+DROP INDEX IF EXISTS segments_name_c_idx;
+
+ALTER TABLE segments DROP COLUMN IF EXISTS created_at;
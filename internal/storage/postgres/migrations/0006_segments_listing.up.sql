@@ -0,0 +1,7 @@
+-- Segments created before the column existed get the migration time.
+ALTER TABLE segments ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+-- The list is ordered by name in the C collation, so that the order does
+-- not depend on the database locale and prefix search can use the index.
+CREATE INDEX segments_name_c_idx ON segments(name COLLATE "C");
+CREATE INDEX segments_created_at_idx ON segments(created_at, name COLLATE "C");
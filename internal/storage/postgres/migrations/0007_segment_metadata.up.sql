@@ -0,0 +1,13 @@
+-- Segments created before the columns existed have no metadata and are
+-- considered not updated since creation.
+ALTER TABLE segments
+	ADD COLUMN description TEXT NOT NULL DEFAULT '',
+	ADD COLUMN owner TEXT NOT NULL DEFAULT '',
+	ADD COLUMN tags TEXT[] NOT NULL DEFAULT '{}',
+	ADD COLUMN created_by TEXT NOT NULL DEFAULT '',
+	ADD COLUMN updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE segments SET updated_at = created_at;
+
+CREATE INDEX segments_owner_idx ON segments(owner);
+CREATE INDEX segments_tags_idx ON segments USING GIN (tags);
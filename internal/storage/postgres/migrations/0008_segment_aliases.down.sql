@@ -0,0 +1,3 @@
+ALTER TABLE segment_audit DROP COLUMN IF EXISTS previous_name;
+
+DROP TABLE IF EXISTS segment_aliases;
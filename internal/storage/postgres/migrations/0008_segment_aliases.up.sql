@@ -0,0 +1,11 @@
+-- Former names of renamed segments. Expired aliases no longer resolve and
+-- are deleted by later renames.
+CREATE TABLE segment_aliases(
+	name TEXT PRIMARY KEY,
+	segment_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX segment_aliases_segment_id_idx ON segment_aliases(segment_id);
+
+ALTER TABLE segment_audit ADD COLUMN previous_name TEXT NOT NULL DEFAULT '';
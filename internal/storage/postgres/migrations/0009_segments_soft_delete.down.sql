@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS archived_user_segments;
+
+DELETE FROM segments WHERE deleted_at IS NOT NULL;
+
+DROP INDEX IF EXISTS segments_deleted_at_idx;
+DROP INDEX IF EXISTS segments_name_key;
+ALTER TABLE segments ADD CONSTRAINT segments_name_key UNIQUE (name);
+
+ALTER TABLE segments DROP COLUMN IF EXISTS deleted_at;
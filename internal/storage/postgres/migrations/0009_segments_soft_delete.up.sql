@@ -0,0 +1,16 @@
+-- Deleted segments are kept with their memberships until purged, so that
+-- they can be restored. Their names are free for new segments.
+ALTER TABLE segments ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE segments DROP CONSTRAINT IF EXISTS segments_name_key;
+CREATE UNIQUE INDEX segments_name_key ON segments(name) WHERE deleted_at IS NULL;
+CREATE INDEX segments_deleted_at_idx ON segments(deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE archived_user_segments(
+	user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	segment_id INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE,
+	expires_at TIMESTAMPTZ,
+	PRIMARY KEY (user_id, segment_id)
+);
+
+CREATE INDEX archived_user_segments_segment_id_idx ON archived_user_segments(segment_id);
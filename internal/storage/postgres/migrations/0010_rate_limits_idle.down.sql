@@ -0,0 +1 @@
+DROP INDEX IF EXISTS rate_limits_updated_at_idx;
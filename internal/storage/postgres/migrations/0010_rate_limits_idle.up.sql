@@ -0,0 +1,2 @@
+-- Idle buckets are deleted by their last update.
+CREATE INDEX rate_limits_updated_at_idx ON rate_limits(updated_at);
@@ -0,0 +1,3 @@
+-- The request holding a key settles it only while the key is still its
+-- own, e.g. not taken over after the reservation expired.
+ALTER TABLE idempotency_keys ADD COLUMN token TEXT NOT NULL DEFAULT '';
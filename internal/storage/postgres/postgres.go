@@ -1,16 +1,51 @@
 package postgres
 
 import (
+	"avito-internship/internal/lib/metrics"
+	"avito-internship/internal/lib/tracing"
+	"avito-internship/internal/storage"
+	"avito-internship/internal/storage/postgres/migrations"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Postgres struct {
-	segmentsTable *sql.DB
-	usersTable    *sql.DB
+	db       *sql.DB
+	timeouts Timeouts
+}
+
+// Timeouts bounds the duration of storage operations. Zero means no timeout.
+type Timeouts struct {
+	// Default applies to operations missing in Operations.
+	Default time.Duration
+	// Operations maps a method name, e.g. CreateSegment, to its timeout.
+	Operations map[string]time.Duration
 }
 
-func New(postgresPath string) (*Postgres, error) {
+func (t Timeouts) For(method string) time.Duration {
+	if timeout, ok := t.Operations[method]; ok {
+		return timeout
+	}
+	return t.Default
+}
+
+var _ storage.Store = (*Postgres)(nil)
+
+// connectTimeout bounds the connectivity check made by New.
+const connectTimeout = 5 * time.Second
+
+// New connects to Postgres and applies pending schema migrations.
+// Operations of the returned storage are bounded by timeouts.
+func New(postgresPath string, timeouts Timeouts) (*Postgres, error) {
 	const op = "storage.postgres.New"
 
 	db, err := sql.Open("postgres", postgresPath)
@@ -18,15 +53,127 @@ func New(postgresPath string) (*Postgres, error) {
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	segmentsTable, err := NewSegmentsTable(db)
-	if err != nil {
+	// sql.Open does not dial, so check the database is actually reachable.
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: failed to connect: %w", op, err)
+	}
+
+	if err := migrations.Up(context.Background(), db); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	usersTable, err := NewUsersTable(db)
+	return &Postgres{db: db, timeouts: timeouts}, nil
+}
+
+func (p *Postgres) Ping(ctx context.Context) (err error) {
+	const op = "storage.postgres.Ping"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	if err := p.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// CheckMigrations returns an error unless all embedded migrations are applied.
+func (p *Postgres) CheckMigrations(ctx context.Context) (err error) {
+	const op = "storage.postgres.CheckMigrations"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	all, err := migrations.Load()
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	version, err := migrations.Version(ctx, p.db)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	return &Postgres{segmentsTable: segmentsTable, usersTable: usersTable}, nil
+	if latest := all[len(all)-1].Version; version < latest {
+		return fmt.Errorf("%s: schema is at version %d, want %d", op, version, latest)
+	}
+
+	return nil
+}
+
+func (p *Postgres) Stats(ctx context.Context) (_ storage.Stats, err error) {
+	const op = "storage.postgres.Stats"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	var stats storage.Stats
+	err = p.db.QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM segments WHERE deleted_at IS NULL),
+			(SELECT COUNT(*) FROM user_segments us JOIN segments s ON s.id = us.segment_id
+				WHERE s.deleted_at IS NULL AND (us.expires_at IS NULL OR us.expires_at > now()))`,
+	).Scan(&stats.Segments, &stats.Memberships)
+	if err != nil {
+		return storage.Stats{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return stats, nil
+}
+
+// Collector returns a collector of connection pool statistics.
+func (p *Postgres) Collector() prometheus.Collector {
+	return collectors.NewDBStatsCollector(p.db, "postgres")
+}
+
+// operation is a storage operation in progress, see startOp.
+type operation struct {
+	op     string
+	ctx    context.Context
+	cancel context.CancelFunc
+	span   trace.Span
+	start  time.Time
+}
+
+// startOp starts the storage operation op: it bounds ctx by the timeout of
+// the operation and starts its span. The operation must be ended by end.
+func (p *Postgres) startOp(ctx context.Context, op string) (context.Context, *operation) {
+	o := &operation{op: op, start: time.Now()}
+
+	ctx, o.span = tracing.StartDB(ctx, op)
+
+	o.cancel = func() {}
+	if timeout := p.timeouts.For(op[strings.LastIndex(op, ".")+1:]); timeout > 0 {
+		ctx, o.cancel = context.WithTimeout(ctx, timeout)
+	}
+	o.ctx = ctx
+
+	return ctx, o
+}
+
+// end records the operation duration and outcome. An error caused by the
+// operation running out of time is replaced with storage.ErrTimeout.
+func (o *operation) end(err *error) {
+	if *err != nil && errors.Is(o.ctx.Err(), context.DeadlineExceeded) && !errors.Is(*err, storage.ErrTimeout) {
+		*err = fmt.Errorf("%s: %w: %v", o.op, storage.ErrTimeout, *err)
+	}
+	o.cancel()
+
+	if *err != nil {
+		o.span.RecordError(*err)
+		o.span.SetStatus(codes.Error, (*err).Error())
+	}
+	o.span.End()
+
+	metrics.ObserveQuery(o.op, o.start)
+}
+
+func (p *Postgres) Close() error {
+	return p.db.Close()
 }
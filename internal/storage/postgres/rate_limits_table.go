@@ -0,0 +1,102 @@
+package postgres
+
+import (
+	"avito-internship/internal/lib/ratelimit"
+	"context"
+	"fmt"
+	"time"
+)
+
+// RateLimiter returns a limiter keeping token buckets in the database, so
+// that clients are limited across all instances of the service.
+func (p *Postgres) RateLimiter() ratelimit.Limiter {
+	return &rateLimiter{p: p}
+}
+
+var _ ratelimit.Sweeper = (*rateLimiter)(nil)
+
+type rateLimiter struct {
+	p *Postgres
+}
+
+// Take takes a token from the bucket key. The bucket row is locked for the
+// duration of the transaction and the database clock is used, so
+// instances with skewed clocks agree on the refill. The clock is read with
+// clock_timestamp() rather than now(), the start of the transaction, as the
+// transaction holding the lock before may have updated the bucket later
+// than that, which would move the bucket back in time.
+func (l *rateLimiter) Take(ctx context.Context, key string, limit ratelimit.Limit) (_ ratelimit.Result, err error) {
+	const op = "storage.postgres.rate_limits_table.Take"
+
+	ctx, o := l.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := l.p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO rate_limits(key, tokens, updated_at) VALUES($1, $2, clock_timestamp())
+		ON CONFLICT (key) DO NOTHING`,
+		key,
+		float64(limit.Burst),
+	)
+	if err != nil {
+		tx.Rollback()
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	var (
+		b   ratelimit.Bucket
+		now time.Time
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT tokens, updated_at, clock_timestamp() FROM rate_limits WHERE key = $1 FOR UPDATE", key,
+	).Scan(&b.Tokens, &b.UpdatedAt, &now)
+	if err != nil {
+		tx.Rollback()
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	b, res := ratelimit.Take(b, limit, now)
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE rate_limits SET tokens = $2, updated_at = $3 WHERE key = $1",
+		key,
+		b.Tokens,
+		b.UpdatedAt,
+	)
+	if err != nil {
+		tx.Rollback()
+		return ratelimit.Result{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ratelimit.Result{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return res, nil
+}
+
+// DeleteIdle deletes the buckets not updated for idle by the database
+// clock.
+func (l *rateLimiter) DeleteIdle(ctx context.Context, idle time.Duration) (_ int64, err error) {
+	const op = "storage.postgres.rate_limits_table.DeleteIdle"
+
+	ctx, o := l.p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := l.p.db.ExecContext(ctx,
+		"DELETE FROM rate_limits WHERE updated_at < clock_timestamp() - $1 * INTERVAL '1 microsecond'", idle.Microseconds())
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,210 @@
+package postgres
+
+import (
+	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// resolveSegment is the id of the not deleted segment named by the slug
+// expression: its name or its not expired alias, the name taking
+// precedence. Aliases of deleted segments are kept for RestoreSegment.
+func resolveSegment(slug string) string {
+	return `COALESCE(
+	(SELECT id FROM segments WHERE name = ` + slug + ` AND deleted_at IS NULL),
+	(SELECT a.segment_id FROM segment_aliases a JOIN segments d ON d.id = a.segment_id
+		WHERE a.name = ` + slug + ` AND a.expires_at > now() AND d.deleted_at IS NULL))`
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// segmentAliases returns the not expired aliases of the segment ordered
+// by expiry.
+func segmentAliases(ctx context.Context, q querier, segmentID int64) ([]storage.SegmentAlias, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT name, expires_at FROM segment_aliases
+		WHERE segment_id = $1 AND expires_at > now()
+		ORDER BY expires_at, name COLLATE "C"`, segmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []storage.SegmentAlias
+	for rows.Next() {
+		var alias storage.SegmentAlias
+		if err := rows.Scan(&alias.Name, &alias.ExpiresAt); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+
+	return aliases, rows.Err()
+}
+
+// aliasTaken tells whether name is a not expired alias of a not deleted
+// segment other than segmentID.
+func aliasTaken(ctx context.Context, tx *sql.Tx, name string, segmentID int64) (bool, error) {
+	var taken bool
+	err := tx.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM segment_aliases a JOIN segments s ON s.id = a.segment_id
+			WHERE a.name = $1 AND a.segment_id <> $2 AND a.expires_at > now() AND s.deleted_at IS NULL)`,
+		name, segmentID).Scan(&taken)
+
+	return taken, err
+}
+
+// SegmentsByAlias returns the segments named by the aliases among slugs.
+// Aliases which are also names of segments are skipped, as the names take
+// precedence.
+func (p *Postgres) SegmentsByAlias(ctx context.Context, slugs []string) (_ map[string]storage.Segment, err error) {
+	const op = "storage.postgres.segment_aliases_table.SegmentsByAlias"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT `+segmentColumns+`, a.name
+		FROM segment_aliases a JOIN segments s ON s.id = a.segment_id
+		WHERE a.name = ANY($1) AND a.expires_at > now() AND s.deleted_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM segments n WHERE n.name = a.name AND n.deleted_at IS NULL)`,
+		pq.StringArray(slugs))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	segments := make(map[string]storage.Segment)
+	for rows.Next() {
+		var (
+			segment storage.Segment
+			alias   string
+		)
+		if err := scanSegment(rows, &segment, &alias); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		segments[alias] = segment
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	for alias, segment := range segments {
+		segment.Aliases, err = segmentAliases(ctx, p.db, segment.ID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: failed to get aliases: %w", op, err)
+		}
+		segments[alias] = segment
+	}
+
+	return segments, nil
+}
+
+// RenameSegment renames the segment keeping its id, so memberships stay.
+// The history is not rewritten: it keeps the names the segment had.
+func (p *Postgres) RenameSegment(ctx context.Context, slug, name string, aliasExpiresAt time.Time) (_ storage.Segment, err error) {
+	const op = "storage.postgres.segment_aliases_table.RenameSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	var (
+		id       int64
+		previous string
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, name FROM segments WHERE id = "+resolveSegment("$1")+" FOR UPDATE", slug).Scan(&id, &previous)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if previous != name {
+		taken, err := aliasTaken(ctx, tx, name, id)
+		if err != nil {
+			tx.Rollback()
+			return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+		}
+		if taken {
+			tx.Rollback()
+			return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"UPDATE segments SET name = $2, updated_at = now() WHERE id = $1", id, name)
+		if err != nil {
+			tx.Rollback()
+			pqErr, ok := err.(*pq.Error)
+			if ok && pqErr.Code == "23505" {
+				return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+			}
+			return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+		}
+
+		// The new name is no longer an alias, e.g. when a segment gets
+		// its former name back. Expired aliases are cleaned up on the way.
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM segment_aliases WHERE name = $1 OR expires_at <= now()", name)
+		if err != nil {
+			tx.Rollback()
+			return storage.Segment{}, fmt.Errorf("%s: failed to delete aliases: %w", op, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO segment_aliases(name, segment_id, expires_at) VALUES($1, $2, $3)
+			ON CONFLICT (name) DO UPDATE SET segment_id = EXCLUDED.segment_id, expires_at = EXCLUDED.expires_at`,
+			previous, id, aliasExpiresAt)
+		if err != nil {
+			tx.Rollback()
+			return storage.Segment{}, fmt.Errorf("%s: failed to save alias: %w", op, err)
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"INSERT INTO segment_audit(segment, action, previous_name, actor) VALUES($1, $2, $3, $4)",
+			name,
+			storage.AuditRename,
+			previous,
+			storage.ActorFromContext(ctx),
+		)
+		if err != nil {
+			tx.Rollback()
+			return storage.Segment{}, fmt.Errorf("%s: failed to write audit: %w", op, err)
+		}
+	}
+
+	var segment storage.Segment
+	err = scanSegment(tx.QueryRowContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.id = $1", id), &segment)
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	segment.Aliases, err = segmentAliases(ctx, tx, id)
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to get aliases: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return segment, nil
+}
@@ -0,0 +1,53 @@
+package postgres
+
+import (
+	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// writeAudit records a change of the segment inside the given transaction.
+func writeAudit(ctx context.Context, tx *sql.Tx, segment, action string) error {
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO segment_audit(segment, action, actor) VALUES($1, $2, $3)",
+		segment,
+		action,
+		storage.ActorFromContext(ctx),
+	)
+
+	return err
+}
+
+// SegmentAudit returns segment changes made in [from, to) ordered by time.
+func (p *Postgres) SegmentAudit(ctx context.Context, from, to time.Time) (_ []storage.AuditRecord, err error) {
+	const op = "storage.postgres.segment_audit_table.SegmentAudit"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT segment, action, previous_name, actor, created_at
+		FROM segment_audit
+		WHERE created_at >= $1 AND created_at < $2
+		ORDER BY created_at, id`, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var records []storage.AuditRecord
+	for rows.Next() {
+		var record storage.AuditRecord
+		if err := rows.Scan(&record.Segment, &record.Action, &record.PreviousName, &record.Actor, &record.CreatedAt); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return records, nil
+}
@@ -2,88 +2,492 @@ package postgres
 
 import (
 	"avito-internship/internal/storage"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/lib/pq"
 )
 
-func NewSegmentsTable(db *sql.DB) (*sql.DB, error) {
-	const op = "storage.postgres.NewSegmentsTable"
+// CreateSegment creates a segment and enrolls autoPercent percent of the
+// existing users into it. Users created later are enrolled by CreateUser.
+func (p *Postgres) CreateSegment(ctx context.Context, segmentToCreate string, autoPercent int, meta storage.SegmentMeta) (_ int64, err error) {
+	const op = "storage.postgres.segments_table.CreateSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
 
-	stmt, err := db.Prepare(`
-	CREATE TABLE IF NOT EXISTS segments(
-		id SERIAL PRIMARY KEY,
-		name TEXT NOT NULL UNIQUE
-	);
-	`)
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return 0, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
 	}
 
-	_, err = stmt.Exec()
+	// Clients may still refer to another segment by the alias.
+	taken, err := aliasTaken(ctx, tx, segmentToCreate, 0)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if taken {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, `
+		INSERT INTO segments(name, auto_percent, description, owner, tags, created_by)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id`,
+		segmentToCreate,
+		autoPercent,
+		meta.Description,
+		meta.Owner,
+		tagsArray(meta.Tags),
+		storage.ActorFromContext(ctx),
+	).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		pqErr, ok := err.(*pq.Error)
+		if ok && pqErr.Code == "23505" {
+			return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+		}
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := writeAudit(ctx, tx, segmentToCreate, storage.AuditCreate); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: failed to write audit: %w", op, err)
 	}
 
-	return db, nil
+	if autoPercent > 0 {
+		if err := enrollExistingUsers(ctx, tx, id, segmentToCreate, autoPercent); err != nil {
+			tx.Rollback()
+			return 0, fmt.Errorf("%s: failed to enroll users: %w", op, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return id, nil
 }
 
-func (p *Postgres) CreateSegment(segmentToCreate string) (int64, error) {
-	const op = "storage.postgres.segments_table.CreateSegment"
+// enrollExistingUsers selects the users in SQL, so that they are not
+// loaded into the service. The segment id is cast to INTEGER wherever it is
+// used, as the type of a parameter must be deduced the same everywhere.
+func enrollExistingUsers(ctx context.Context, tx *sql.Tx, segmentID int64, segment string, percent int) error {
+	_, err := tx.ExecContext(ctx, `
+		WITH enrolled AS (
+			INSERT INTO user_segments(user_id, segment_id)
+			SELECT id, $1::INTEGER FROM users
+			WHERE `+rolloutSelected("id", "$1::INTEGER", "$3::INTEGER")+`
+			RETURNING user_id
+		)
+		INSERT INTO users_segments_history(user_id, segment, operation, actor)
+		SELECT user_id, $2, $4, $5 FROM enrolled`,
+		segmentID,
+		segment,
+		percent,
+		storage.OperationAdd,
+		storage.ActorFromContext(ctx),
+	)
 
-	tx, err := p.segmentsTable.Begin()
+	return err
+}
+
+// segmentColumns are the columns scanned by scanSegment.
+const segmentColumns = "s.id, s.name, s.auto_percent, s.description, s.owner, s.tags, s.created_by, s.created_at, s.updated_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSegment scans segmentColumns followed by extra columns.
+func scanSegment(row scanner, segment *storage.Segment, extra ...interface{}) error {
+	dest := []interface{}{
+		&segment.ID,
+		&segment.Name,
+		&segment.AutoPercent,
+		&segment.Description,
+		&segment.Owner,
+		pq.Array(&segment.Tags),
+		&segment.CreatedBy,
+		&segment.CreatedAt,
+		&segment.UpdatedAt,
+	}
+
+	return row.Scan(append(dest, extra...)...)
+}
+
+// tagsArray converts tags to a TEXT[] value, nil tags to an empty array.
+func tagsArray(tags []string) pq.StringArray {
+	if tags == nil {
+		return pq.StringArray{}
+	}
+	return pq.StringArray(tags)
+}
+
+func (p *Postgres) GetSegment(ctx context.Context, slug string) (_ storage.Segment, err error) {
+	const op = "storage.postgres.segments_table.GetSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	var segment storage.Segment
+	err = scanSegment(p.db.QueryRowContext(ctx,
+		"SELECT "+segmentColumns+" FROM segments s WHERE s.id = "+resolveSegment("$1"), slug), &segment)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	segment.Aliases, err = segmentAliases(ctx, p.db, segment.ID)
+	if err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to get aliases: %w", op, err)
+	}
+
+	return segment, nil
+}
+
+// UpdateSegment replaces the metadata of the segment and records the
+// change in the audit trail.
+func (p *Postgres) UpdateSegment(ctx context.Context, slug string, meta storage.SegmentMeta) (_ storage.Segment, err error) {
+	const op = "storage.postgres.segments_table.UpdateSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	var segment storage.Segment
+	err = scanSegment(tx.QueryRowContext(ctx, `
+		UPDATE segments s SET description = $2, owner = $3, tags = $4, updated_at = now()
+		WHERE s.id = `+resolveSegment("$1")+`
+		RETURNING `+segmentColumns,
+		slug,
+		meta.Description,
+		meta.Owner,
+		tagsArray(meta.Tags),
+	), &segment)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := writeAudit(ctx, tx, segment.Name, storage.AuditUpdate); err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to write audit: %w", op, err)
+	}
+
+	segment.Aliases, err = segmentAliases(ctx, tx, segment.ID)
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to get aliases: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return segment, nil
+}
+
+// DeleteSegment marks the segment deleted, moves its memberships to
+// archived_user_segments and records the removal of every member in the
+// history. Its aliases are kept, so that it can be restored by them.
+func (p *Postgres) DeleteSegment(ctx context.Context, slug string) (_ int64, err error) {
+	const op = "storage.postgres.segments_table.DeleteSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return 0, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
 	}
 
-	stmt, err := p.segmentsTable.Prepare("INSERT INTO segments(name) VALUES(DEFAULT, $1)")
+	var (
+		id   int64
+		name string
+	)
+	err = tx.QueryRowContext(ctx,
+		"SELECT id, name FROM segments WHERE id = "+resolveSegment("$1")+" FOR UPDATE", slug).Scan(&id, &name)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO users_segments_history(user_id, segment, operation, actor)
+		SELECT user_id, $2::TEXT, $3::TEXT, $4::TEXT FROM user_segments WHERE segment_id = $1`,
+		id,
+		name,
+		storage.OperationRemove,
+		storage.ActorFromContext(ctx),
+	)
 	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: failed to write history: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		WITH moved AS (DELETE FROM user_segments WHERE segment_id = $1 RETURNING user_id, segment_id, expires_at)
+		INSERT INTO archived_user_segments(user_id, segment_id, expires_at)
+		SELECT user_id, segment_id, expires_at FROM moved`, id)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: failed to archive memberships: %w", op, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE segments SET deleted_at = now() WHERE id = $1", id); err != nil {
 		tx.Rollback()
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	res, err := stmt.Exec(segmentToCreate)
+	if err := writeAudit(ctx, tx, name, storage.AuditDelete); err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("%s: failed to write audit: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return id, nil
+}
+
+// RestoreSegment restores the latest segment with the name or alias deleted
+// after deletedAfter. Memberships expired meanwhile are not restored, nor
+// are aliases which became names of other segments.
+func (p *Postgres) RestoreSegment(ctx context.Context, slug string, deletedAfter time.Time) (_ storage.Segment, err error) {
+	const op = "storage.postgres.segments_table.RestoreSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	var (
+		id   int64
+		name string
+	)
+	err = tx.QueryRowContext(ctx, `
+		SELECT s.id, s.name FROM segments s
+		WHERE s.deleted_at > $2 AND (s.name = $1 OR EXISTS (
+			SELECT 1 FROM segment_aliases a WHERE a.segment_id = s.id AND a.name = $1 AND a.expires_at > now()))
+		ORDER BY s.name = $1 DESC, s.deleted_at DESC LIMIT 1 FOR UPDATE`, slug, deletedAfter).Scan(&id, &name)
+	if errors.Is(err, sql.ErrNoRows) {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentNotFound)
+	}
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	taken, err := aliasTaken(ctx, tx, name, id)
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
+	}
+	if taken {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+	}
+
+	var segment storage.Segment
+	err = scanSegment(tx.QueryRowContext(ctx, `
+		UPDATE segments s SET deleted_at = NULL, updated_at = now() WHERE s.id = $1
+		RETURNING `+segmentColumns, id), &segment)
 	if err != nil {
 		tx.Rollback()
 		pqErr, ok := err.(*pq.Error)
 		if ok && pqErr.Code == "23505" {
-			return 0, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
+			return storage.Segment{}, fmt.Errorf("%s: %w", op, storage.ErrSegmentExists)
 		}
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return storage.Segment{}, fmt.Errorf("%s: %w", op, err)
 	}
 
-	id, err := res.LastInsertId()
+	_, err = tx.ExecContext(ctx, `
+		WITH archived AS (
+			DELETE FROM archived_user_segments WHERE segment_id = $1
+			RETURNING user_id, segment_id, expires_at
+		), restored AS (
+			INSERT INTO user_segments(user_id, segment_id, expires_at)
+			SELECT user_id, segment_id, expires_at FROM archived
+			WHERE expires_at IS NULL OR expires_at > now()
+			RETURNING user_id
+		)
+		INSERT INTO users_segments_history(user_id, segment, operation, actor)
+		SELECT user_id, $2::TEXT, $3::TEXT, $4::TEXT FROM restored`,
+		id,
+		name,
+		storage.OperationAdd,
+		storage.ActorFromContext(ctx),
+	)
 	if err != nil {
 		tx.Rollback()
-		return 0, fmt.Errorf("%s: failed to get last insert id: %w", op, err)
+		return storage.Segment{}, fmt.Errorf("%s: failed to restore memberships: %w", op, err)
 	}
 
-	err = tx.Commit()
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM segment_aliases a USING segments s
+		WHERE a.segment_id = $1 AND s.name = a.name AND s.deleted_at IS NULL`, id)
 	if err != nil {
-		return 0, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to delete aliases: %w", op, err)
 	}
 
-	return id, nil
+	if err := writeAudit(ctx, tx, name, storage.AuditRestore); err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to write audit: %w", op, err)
+	}
+
+	segment.Aliases, err = segmentAliases(ctx, tx, id)
+	if err != nil {
+		tx.Rollback()
+		return storage.Segment{}, fmt.Errorf("%s: failed to get aliases: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storage.Segment{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return segment, nil
 }
 
-func (p *Postgres) DeleteSegment(segmentToDelete string) (int64, error) {
-	const op = "storage.postgres.segments_table.DeleteSegment"
+// PurgeSegments permanently removes segments deleted before deletedBefore,
+// their archived memberships are removed by ON DELETE CASCADE.
+func (p *Postgres) PurgeSegments(ctx context.Context, deletedBefore time.Time) (_ int64, err error) {
+	const op = "storage.postgres.segments_table.PurgeSegments"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
 
-	stmt, err := p.segmentsTable.Prepare("DELETE FROM segments WHERE name = $1")
+	res, err := p.db.ExecContext(ctx, `
+		WITH purged AS (
+			DELETE FROM segments WHERE deleted_at <= $1 RETURNING name
+		)
+		INSERT INTO segment_audit(segment, action, actor)
+		SELECT name, $2::TEXT, $3::TEXT FROM purged`,
+		deletedBefore,
+		storage.AuditPurge,
+		storage.ActorFromContext(ctx),
+	)
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	res, err := stmt.Exec(segmentToDelete)
+	purged, err := res.RowsAffected()
 	if err != nil {
 		return 0, fmt.Errorf("%s: %w", op, err)
 	}
 
-	rowsAffected, err := res.RowsAffected()
+	return purged, nil
+}
+
+// ListSegments returns up to filter.Limit segments matching filter. Names
+// are compared in the C collation, as they are by the memory storage.
+func (p *Postgres) ListSegments(ctx context.Context, filter storage.SegmentFilter) (_ []storage.Segment, err error) {
+	const op = "storage.postgres.segments_table.ListSegments"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	var (
+		where = []string{"s.deleted_at IS NULL"}
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	if filter.Prefix != "" {
+		where = append(where, `s.name COLLATE "C" LIKE `+arg(escapeLike(filter.Prefix)+"%"))
+	}
+	if filter.Contains != "" {
+		where = append(where, `s.name COLLATE "C" LIKE `+arg("%"+escapeLike(filter.Contains)+"%"))
+	}
+	if filter.Owner != "" {
+		where = append(where, "s.owner = "+arg(filter.Owner))
+	}
+	if filter.Tag != "" {
+		where = append(where, "s.tags @> "+arg(pq.StringArray{filter.Tag})+"::TEXT[]")
+	}
+
+	cmp, dir := ">", "ASC"
+	if filter.Desc {
+		cmp, dir = "<", "DESC"
+	}
+
+	orderBy := `s.name COLLATE "C" ` + dir
+	if filter.Sort == storage.SortByCreatedAt {
+		orderBy = `s.created_at ` + dir + `, s.name COLLATE "C" ` + dir
+	}
+
+	if filter.After != nil {
+		if filter.Sort == storage.SortByCreatedAt {
+			where = append(where, fmt.Sprintf(`(s.created_at, s.name COLLATE "C") %s (%s, %s)`,
+				cmp, arg(filter.After.CreatedAt), arg(filter.After.Name)))
+		} else {
+			where = append(where, fmt.Sprintf(`s.name COLLATE "C" %s %s`, cmp, arg(filter.After.Name)))
+		}
+	}
+
+	members := "0"
+	if filter.WithMembers {
+		members = `(SELECT COUNT(*) FROM user_segments us
+			WHERE us.segment_id = s.id AND (us.expires_at IS NULL OR us.expires_at > now()))`
+	}
+
+	query := "SELECT " + segmentColumns + ", " + members + " FROM segments s"
+	query += " WHERE " + strings.Join(where, " AND ")
+	query += " ORDER BY " + orderBy + " LIMIT " + arg(filter.Limit)
+
+	rows, err := p.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return 0, fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	segments := []storage.Segment{}
+	for rows.Next() {
+		var segment storage.Segment
+		if err := scanSegment(rows, &segment, &segment.Members); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+		segments = append(segments, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
 	}
 
-	return rowsAffected, nil
+	return segments, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
 }
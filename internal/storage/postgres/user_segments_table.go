@@ -0,0 +1,630 @@
+package postgres
+
+import (
+	"avito-internship/internal/lib/rollout"
+	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// AddUserToSegment adds the user to segments. Segments present in expires
+// are removed from the user automatically once their expiry time has passed.
+func (p *Postgres) AddUserToSegment(ctx context.Context, user_id int64, segments []string, expires map[string]time.Time) (err error) {
+	const op = "storage.postgres.user_segments_table.AddUserToSegment"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	if err := lockUser(ctx, tx, user_id); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addSegments(ctx, tx, user_id, segments, expires, true); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) RemoveSegmentsFromUser(ctx context.Context, user_id int64, segments []string) (err error) {
+	const op = "storage.postgres.user_segments_table.RemoveSegmentsFromUser"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	if err := lockUser(ctx, tx, user_id); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := removeSegments(ctx, tx, user_id, segments); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return nil
+}
+
+// UpdateUserSegments adds and removes user segments in a single transaction
+// and returns the resulting active segments of the user.
+func (p *Postgres) UpdateUserSegments(ctx context.Context, user_id int64, add, remove []string) (_ []string, err error) {
+	const op = "storage.postgres.user_segments_table.UpdateUserSegments"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	if err := storage.CheckSegmentsConflict(add, remove); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	if err := lockUser(ctx, tx, user_id); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := checkResolvedConflict(ctx, tx, add, remove); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := addSegments(ctx, tx, user_id, add, nil, false); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := removeSegments(ctx, tx, user_id, remove); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	segments, err := activeSegments(ctx, tx, user_id)
+	if err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return segments, nil
+}
+
+// checkResolvedConflict returns storage.ErrSegmentConflict if a segment is
+// both in add and remove under different slugs, e.g. its name and an alias.
+func checkResolvedConflict(ctx context.Context, tx *sql.Tx, add, remove []string) error {
+	if len(add) == 0 || len(remove) == 0 {
+		return nil
+	}
+
+	added, err := existingSegmentIDs(ctx, tx, add)
+	if err != nil {
+		return err
+	}
+	removed, err := existingSegmentIDs(ctx, tx, remove)
+	if err != nil {
+		return err
+	}
+
+	ids := make(map[int64]bool, len(added))
+	for _, ref := range added {
+		ids[ref.id] = true
+	}
+	for _, ref := range removed {
+		if ids[ref.id] {
+			return fmt.Errorf("%w: %s", storage.ErrSegmentConflict, ref.name)
+		}
+	}
+
+	return nil
+}
+
+// addSegments must be called with the user locked by lockUser. Existing
+// memberships get their expiry from expires if replaceExpiry and are kept
+// as they are otherwise.
+func addSegments(ctx context.Context, tx *sql.Tx, user_id int64, segments []string, expires map[string]time.Time, replaceExpiry bool) error {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	refs, err := segmentIDs(ctx, tx, segments)
+	if err != nil {
+		return err
+	}
+
+	conflict := "DO UPDATE SET expires_at = EXCLUDED.expires_at"
+	if !replaceExpiry {
+		conflict = "DO UPDATE SET expires_at = user_segments.expires_at"
+	}
+
+	var added []string
+	for _, segment := range segments {
+		var expiresAt *time.Time
+		if t, ok := expires[segment]; ok {
+			expiresAt = &t
+		}
+		ref := refs[segment]
+
+		var inserted bool
+		err := tx.QueryRowContext(ctx, `
+			INSERT INTO user_segments(user_id, segment_id, expires_at) VALUES($1, $2, $3)
+			ON CONFLICT (user_id, segment_id) `+conflict+`
+			RETURNING (xmax = 0)`,
+			user_id,
+			ref.id,
+			expiresAt,
+		).Scan(&inserted)
+		if err != nil {
+			return err
+		}
+		if inserted {
+			added = append(added, ref.name)
+		}
+	}
+
+	if err := writeHistory(ctx, tx, user_id, added, storage.OperationAdd); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	return nil
+}
+
+// removeSegments must be called with the user locked by lockUser.
+func removeSegments(ctx context.Context, tx *sql.Tx, user_id int64, segments []string) error {
+	if len(segments) == 0 {
+		return nil
+	}
+
+	refs, err := segmentIDs(ctx, tx, segments)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int64, 0, len(refs))
+	for _, ref := range refs {
+		ids = append(ids, ref.id)
+	}
+
+	removed, err := scanSegments(tx.QueryContext(ctx, `
+		DELETE FROM user_segments us USING segments s
+		WHERE us.segment_id = s.id AND us.user_id = $1 AND s.id = ANY($2)
+		RETURNING s.name`,
+		user_id,
+		pq.Int64Array(ids),
+	))
+	if err != nil {
+		return err
+	}
+
+	if err := writeHistory(ctx, tx, user_id, removed, storage.OperationRemove); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) ShowActiveSegmentUser(ctx context.Context, user_id int64) (_ []string, err error) {
+	const op = "storage.postgres.user_segments_table.ShowActiveSegmentUser"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	userExists, err := p.UserExists(ctx, user_id)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if !userExists {
+		return nil, fmt.Errorf("%s: %w", op, storage.ErrUserNotFound)
+	}
+
+	segments, err := scanSegments(p.db.QueryContext(ctx, activeSegmentsQuery, user_id))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return segments, nil
+}
+
+const activeSegmentsQuery = `
+	SELECT s.name
+	FROM user_segments us
+	JOIN segments s ON s.id = us.segment_id
+	WHERE us.user_id = $1 AND s.deleted_at IS NULL AND (us.expires_at IS NULL OR us.expires_at > now())
+	ORDER BY s.name`
+
+func activeSegments(ctx context.Context, tx *sql.Tx, user_id int64) ([]string, error) {
+	return scanSegments(tx.QueryContext(ctx, activeSegmentsQuery, user_id))
+}
+
+// RemoveExpiredSegments removes memberships expired by now and records
+// them in the history. It returns the number of removed memberships.
+func (p *Postgres) RemoveExpiredSegments(ctx context.Context, now time.Time) (_ int64, err error) {
+	const op = "storage.postgres.user_segments_table.RemoveExpiredSegments"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	res, err := p.db.ExecContext(ctx, `
+		WITH expired AS (
+			DELETE FROM user_segments us USING segments s
+			WHERE us.segment_id = s.id AND us.expires_at <= $1
+			RETURNING us.user_id, s.name
+		)
+		INSERT INTO users_segments_history(user_id, segment, operation, actor)
+		SELECT user_id, name, $2::TEXT, $3::TEXT FROM expired`,
+		now,
+		storage.OperationExpire,
+		storage.ActorFromContext(ctx),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	return removed, nil
+}
+
+func scanSegments(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []string
+	for rows.Next() {
+		var segment string
+		if err := rows.Scan(&segment); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+// AddSegmentMembers locks the segment and the users, so that it is
+// serialized with membership changes of the same users and deletion of
+// the segment.
+func (p *Postgres) AddSegmentMembers(ctx context.Context, segmentID int64, users []int64, createMissing bool) (_ storage.MembersResult, err error) {
+	const op = "storage.postgres.user_segments_table.AddSegmentMembers"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.MembersResult{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	res, err := addSegmentMembers(ctx, tx, segmentID, users, createMissing)
+	if err != nil {
+		tx.Rollback()
+		return storage.MembersResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storage.MembersResult{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return res, nil
+}
+
+func addSegmentMembers(ctx context.Context, tx *sql.Tx, segmentID int64, users []int64, createMissing bool) (storage.MembersResult, error) {
+	segment, err := lockSegment(ctx, tx, segmentID)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+
+	ids := distinct(users)
+
+	existing, err := lockUsers(ctx, tx, ids)
+	if err != nil {
+		return storage.MembersResult{}, fmt.Errorf("failed to lock users: %w", err)
+	}
+
+	var res storage.MembersResult
+
+	var missing []int64
+	for _, id := range ids {
+		if !existing[id] {
+			missing = append(missing, id)
+		}
+	}
+
+	var created []int64
+	if createMissing && len(missing) > 0 {
+		// Users created concurrently are not created again but still join
+		// the segment.
+		rows, err := tx.QueryContext(ctx,
+			"INSERT INTO users(id) SELECT unnest($1::BIGINT[]) ON CONFLICT DO NOTHING RETURNING id", pq.Int64Array(missing))
+		if err != nil {
+			return storage.MembersResult{}, fmt.Errorf("failed to create users: %w", err)
+		}
+		created, err = scanIDs(rows)
+		if err != nil {
+			return storage.MembersResult{}, fmt.Errorf("failed to create users: %w", err)
+		}
+
+		for _, id := range missing {
+			existing[id] = true
+		}
+		res.Created = int64(len(created))
+	}
+
+	members := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if existing[id] {
+			members = append(members, id)
+		}
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		INSERT INTO user_segments(user_id, segment_id) SELECT unnest($1::BIGINT[]), $2
+		ON CONFLICT (user_id, segment_id) DO NOTHING
+		RETURNING user_id`,
+		pq.Int64Array(members),
+		segmentID,
+	)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+	added, err := scanIDs(rows)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+
+	history := make([]string, len(added))
+	for i := range history {
+		history[i] = segment
+	}
+	if err := writeBulkHistory(ctx, tx, added, history, storage.OperationAdd); err != nil {
+		return storage.MembersResult{}, fmt.Errorf("failed to write history: %w", err)
+	}
+
+	if err := enrollCreatedUsers(ctx, tx, created, segment); err != nil {
+		return storage.MembersResult{}, fmt.Errorf("failed to enroll created users: %w", err)
+	}
+
+	res.Changed = int64(len(added))
+	countMembers(&res, users, existing)
+
+	return res, nil
+}
+
+// enrollCreatedUsers adds users created by AddSegmentMembers to segments
+// with automatic enrollment, except the segment they were added to.
+func enrollCreatedUsers(ctx context.Context, tx *sql.Tx, users []int64, segment string) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	segments, err := autoSegments(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	var (
+		userIDs    []int64
+		segmentIDs []int64
+		names      []string
+	)
+	for _, id := range users {
+		for _, s := range segments {
+			if s.name != segment && rollout.Selected(id, s.id, s.percent) {
+				userIDs = append(userIDs, id)
+				segmentIDs = append(segmentIDs, s.id)
+				names = append(names, s.name)
+			}
+		}
+	}
+
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO user_segments(user_id, segment_id) SELECT * FROM unnest($1::BIGINT[], $2::BIGINT[])",
+		pq.Int64Array(userIDs),
+		pq.Int64Array(segmentIDs),
+	)
+	if err != nil {
+		return err
+	}
+
+	return writeBulkHistory(ctx, tx, userIDs, names, storage.OperationAdd)
+}
+
+// RemoveSegmentMembers locks the segment and the users like
+// AddSegmentMembers.
+func (p *Postgres) RemoveSegmentMembers(ctx context.Context, segmentID int64, users []int64) (_ storage.MembersResult, err error) {
+	const op = "storage.postgres.user_segments_table.RemoveSegmentMembers"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.MembersResult{}, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	res, err := removeSegmentMembers(ctx, tx, segmentID, users)
+	if err != nil {
+		tx.Rollback()
+		return storage.MembersResult{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return storage.MembersResult{}, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return res, nil
+}
+
+func removeSegmentMembers(ctx context.Context, tx *sql.Tx, segmentID int64, users []int64) (storage.MembersResult, error) {
+	segment, err := lockSegment(ctx, tx, segmentID)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+
+	ids := distinct(users)
+
+	existing, err := lockUsers(ctx, tx, ids)
+	if err != nil {
+		return storage.MembersResult{}, fmt.Errorf("failed to lock users: %w", err)
+	}
+
+	rows, err := tx.QueryContext(ctx,
+		"DELETE FROM user_segments WHERE segment_id = $1 AND user_id = ANY($2) RETURNING user_id",
+		segmentID,
+		pq.Int64Array(ids),
+	)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+	removed, err := scanIDs(rows)
+	if err != nil {
+		return storage.MembersResult{}, err
+	}
+
+	history := make([]string, len(removed))
+	for i := range history {
+		history[i] = segment
+	}
+	if err := writeBulkHistory(ctx, tx, removed, history, storage.OperationRemove); err != nil {
+		return storage.MembersResult{}, fmt.Errorf("failed to write history: %w", err)
+	}
+
+	res := storage.MembersResult{Changed: int64(len(removed))}
+	countMembers(&res, users, existing)
+
+	return res, nil
+}
+
+// lockSegment returns the name of the segment and locks it against
+// deletion until the end of the transaction.
+func lockSegment(ctx context.Context, tx *sql.Tx, segmentID int64) (string, error) {
+	var name string
+	err := tx.QueryRowContext(ctx,
+		"SELECT name FROM segments WHERE id = $1 AND deleted_at IS NULL FOR SHARE", segmentID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", storage.ErrSegmentNotFound
+	}
+
+	return name, err
+}
+
+// lockUsers locks the existing users like lockUser, in the order of ids
+// to avoid deadlocks, and returns which of them exist.
+func lockUsers(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]bool, error) {
+	rows, err := tx.QueryContext(ctx,
+		"SELECT id FROM users WHERE id = ANY($1) ORDER BY id FOR UPDATE", pq.Int64Array(ids))
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := make(map[int64]bool, len(ids))
+	for _, id := range locked {
+		existing[id] = true
+	}
+
+	return existing, nil
+}
+
+// countMembers sets the users which were not changed: unknown users by
+// index and the others, including repeats, as unchanged.
+func countMembers(res *storage.MembersResult, users []int64, existing map[int64]bool) {
+	for i, id := range users {
+		if !existing[id] {
+			res.Unknown = append(res.Unknown, i)
+		}
+	}
+
+	res.Unchanged = int64(len(users)-len(res.Unknown)) - res.Changed
+}
+
+// writeBulkHistory writes a history record per user and segment at the
+// same index with a single statement.
+func writeBulkHistory(ctx context.Context, tx *sql.Tx, users []int64, segments []string, operation string) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO users_segments_history(user_id, segment, operation, actor)
+		SELECT user_id, segment, $3, $4 FROM unnest($1::BIGINT[], $2::TEXT[]) AS h(user_id, segment)`,
+		pq.Int64Array(users),
+		pq.StringArray(segments),
+		operation,
+		storage.ActorFromContext(ctx),
+	)
+
+	return err
+}
+
+func scanIDs(rows *sql.Rows) ([]int64, error) {
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// distinct returns ids without repeats, in order of their first occurrence.
+func distinct(ids []int64) []int64 {
+	seen := make(map[int64]bool, len(ids))
+	res := make([]int64, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			res = append(res, id)
+		}
+	}
+
+	return res
+}
@@ -1,126 +1,362 @@
 package postgres
 
 import (
+	"avito-internship/internal/lib/rollout"
+	"avito-internship/internal/storage"
+	"context"
 	"database/sql"
 	"fmt"
 
 	"github.com/lib/pq"
 )
 
-func NewUsersTable(db *sql.DB) (*sql.DB, error) {
-	const op = "storage.postgres.NewUsersTable"
+// CreateUser creates a user with the given segments. The user is also
+// enrolled into segments created with an automatic enrollment percent.
+func (p *Postgres) CreateUser(ctx context.Context, user_id int64, segments []string) (err error) {
+	const op = "storage.postgres.users_table.CreateUser"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
 
-	tx, err := db.Begin()
+	segments, err = p.validateSegments(segments)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	stmt, err := tx.Prepare(`
-	CREATE TABLE IF NOT EXISTS users(
-		id SERIAL PRIMARY KEY,
-		segments pq.StringArray
-	);
-	`)
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("%s: failed to begin transaction: %w", op, err)
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users(id) VALUES($1)", user_id)
 	if err != nil {
 		tx.Rollback()
-		return nil, fmt.Errorf("%s: %w", op, err)
+		pqErr, ok := err.(*pq.Error)
+		if ok && pqErr.Code == "23505" {
+			return fmt.Errorf("%s: %w", op, storage.ErrUserExists)
+		}
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	_, err = stmt.Exec()
+	refs, err := segmentIDs(ctx, tx, segments)
 	if err != nil {
 		tx.Rollback()
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return fmt.Errorf("%s: %w", op, err)
 	}
 
-	err = tx.Commit()
+	autoSegments, err := autoEnrolledSegments(ctx, tx, user_id)
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		tx.Rollback()
+		return fmt.Errorf("%s: failed to get auto segments: %w", op, err)
+	}
+
+	// A segment named both by its name and by an alias is added once.
+	var memberships []segmentRef
+	requested := make(map[int64]bool, len(segments))
+	for _, segment := range segments {
+		if ref := refs[segment]; !requested[ref.id] {
+			requested[ref.id] = true
+			memberships = append(memberships, ref)
+		}
+	}
+	for _, ref := range autoSegments {
+		if !requested[ref.id] {
+			memberships = append(memberships, ref)
+		}
 	}
 
-	return db, nil
+	names := make([]string, 0, len(memberships))
+	for _, ref := range memberships {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO user_segments(user_id, segment_id) VALUES($1, $2)",
+			user_id,
+			ref.id,
+		)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		names = append(names, ref.name)
+	}
+
+	if err := writeHistory(ctx, tx, user_id, names, storage.OperationAdd); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: failed to write history: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return nil
 }
 
-func (p *Postgres) CreateUser(user_id int64, segments []string) error {
-	const op = "storage.postgres.users_table.CreateUser"
+// autoEnrolledSegments returns segments with automatic enrollment the user falls into.
+func autoEnrolledSegments(ctx context.Context, tx *sql.Tx, user_id int64) ([]segmentRef, error) {
+	segments, err := autoSegments(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
 
-	segments, err := p.validateSegments(segments)
+	var selected []segmentRef
+	for _, segment := range segments {
+		if rollout.Selected(user_id, segment.id, segment.percent) {
+			selected = append(selected, segmentRef{id: segment.id, name: segment.name})
+		}
+	}
+
+	return selected, nil
+}
+
+// importedMembership is a membership of a user created by ImportUsers.
+type importedMembership struct {
+	userID    int64
+	segmentID int64
+	segment   string
+}
+
+// ImportUsers checks the users with a few queries and creates the valid
+// ones with COPY. A user created concurrently after the check is skipped
+// and reported with storage.ErrUserExists like an existing one.
+func (p *Postgres) ImportUsers(ctx context.Context, users []storage.ImportedUser, dryRun bool) (_ map[int]error, err error) {
+	const op = "storage.postgres.users_table.ImportUsers"
+
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		return nil, fmt.Errorf("%s: failed to begin transaction: %w", op, err)
 	}
 
-	stmt, err := p.usersTable.Prepare("INSERT INTO users(id, segments) VALUES(?,?)")
+	failed, memberships, err := checkImportedUsers(ctx, tx, users)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+
+	if dryRun {
+		tx.Rollback()
+		return failed, nil
+	}
+
+	ids := make([][]interface{}, 0, len(users))
+	for i, user := range users {
+		if _, ok := failed[i]; !ok {
+			ids = append(ids, []interface{}{user.UserID})
+		}
 	}
 
-	_, err = stmt.Exec(user_id, pq.StringArray(segments))
+	created, err := createImportedUsers(ctx, tx, ids)
 	if err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: failed to copy users: %w", op, err)
 	}
 
-	return nil
+	for i, user := range users {
+		if _, ok := failed[i]; !ok && !created[user.UserID] {
+			failed[i] = storage.ErrUserExists
+		}
+	}
+
+	segments := make([][]interface{}, 0, len(memberships))
+	history := make([][]interface{}, 0, len(memberships))
+	actor := storage.ActorFromContext(ctx)
+	for _, m := range memberships {
+		if !created[m.userID] {
+			continue
+		}
+		segments = append(segments, []interface{}{m.userID, m.segmentID})
+		history = append(history, []interface{}{m.userID, m.segment, storage.OperationAdd, actor})
+	}
+
+	if err := copyRows(ctx, tx, "user_segments", []string{"user_id", "segment_id"}, segments); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: failed to copy memberships: %w", op, err)
+	}
+
+	if err := copyRows(ctx, tx, "users_segments_history", []string{"user_id", "segment", "operation", "actor"}, history); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("%s: failed to write history: %w", op, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("%s: failed to commit transaction: %w", op, err)
+	}
+
+	return failed, nil
 }
 
-func (p *Postgres) AddUserToSegment(user_id int64, segments []string) error {
-	const op = "storage.postgres.users_table.AddUserToSegment"
+// createImportedUsers creates the users which do not exist yet and returns
+// the created ones. COPY cannot skip conflicting rows, so the users are
+// copied into a staging table and inserted from it.
+func createImportedUsers(ctx context.Context, tx *sql.Tx, ids [][]interface{}) (map[int64]bool, error) {
+	created := make(map[int64]bool, len(ids))
+	if len(ids) == 0 {
+		return created, nil
+	}
 
-	if err := p.validateUserAndSegment(user_id, segments); err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+	if _, err := tx.ExecContext(ctx, "CREATE TEMP TABLE imported_users(id BIGINT NOT NULL) ON COMMIT DROP"); err != nil {
+		return nil, err
 	}
 
-	for _, segment := range segments {
-		_, err := p.usersTable.Exec(
-			"UPDATE users SET segments = pq.ArrayAppend(segments, $1) WHERE id = $2",
-			segment,
-			user_id,
-		)
-		if err != nil {
-			return fmt.Errorf("%s: %w", op, err)
-		}
+	if err := copyRows(ctx, tx, "imported_users", []string{"id"}, ids); err != nil {
+		return nil, err
 	}
 
-	return nil
+	rows, err := tx.QueryContext(ctx,
+		"INSERT INTO users(id) SELECT id FROM imported_users ORDER BY id ON CONFLICT DO NOTHING RETURNING id")
+	if err != nil {
+		return nil, err
+	}
+	inserted, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range inserted {
+		created[id] = true
+	}
+
+	return created, nil
 }
 
-func (p *Postgres) RemoveSegmentsFromUser(user_id int64, segments []string) error {
-	const op = "storage.postgres.users_table.RemoveSegmentsFromUser"
+// checkImportedUsers returns the errors of users which cannot be created,
+// by index in users, and the memberships of the others including
+// automatic segments, in the order CreateUser adds them.
+func checkImportedUsers(ctx context.Context, tx *sql.Tx, users []storage.ImportedUser) (map[int]error, []importedMembership, error) {
+	ids := make([]int64, 0, len(users))
+	var names []string
+	for _, user := range users {
+		ids = append(ids, user.UserID)
+		names = append(names, user.Segments...)
+	}
 
-	if err := p.validateUserAndSegment(user_id, segments); err != nil {
-		return fmt.Errorf("%s: %w", op, err)
+	existing, err := existingUsers(ctx, tx, ids)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get existing users: %w", err)
 	}
 
-	for _, segment := range segments {
-		_, err := p.usersTable.Exec(
-			"UPDATE users SET segments = pq.ArrayDelete(segments, $1) WHERE id = $2",
-			segment,
-			user_id,
-		)
-		if err != nil {
-			return fmt.Errorf("%s: %w", op, err)
+	known, err := existingSegmentIDs(ctx, tx, names)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get segments: %w", err)
+	}
+
+	autoSegments, err := autoSegments(ctx, tx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get auto segments: %w", err)
+	}
+
+	failed := make(map[int]error)
+	var memberships []importedMembership
+
+next:
+	for i, user := range users {
+		if existing[user.UserID] {
+			failed[i] = storage.ErrUserExists
+			continue
+		}
+
+		// A segment named both by its name and by an alias is a duplicate.
+		requested := make(map[int64]bool, len(user.Segments))
+		for _, segment := range user.Segments {
+			ref, ok := known[segment]
+			if !ok {
+				failed[i] = fmt.Errorf("%w: %s", storage.ErrSegmentNotFound, segment)
+				continue next
+			}
+
+			if requested[ref.id] {
+				failed[i] = storage.ErrDuplicateSegments
+				continue next
+			}
+			requested[ref.id] = true
+		}
+
+		existing[user.UserID] = true
+
+		for _, segment := range user.Segments {
+			ref := known[segment]
+			memberships = append(memberships, importedMembership{userID: user.UserID, segmentID: ref.id, segment: ref.name})
+		}
+		for _, segment := range autoSegments {
+			if !requested[segment.id] && rollout.Selected(user.UserID, segment.id, segment.percent) {
+				memberships = append(memberships, importedMembership{userID: user.UserID, segmentID: segment.id, segment: segment.name})
+			}
 		}
 	}
 
-	return nil
+	return failed, memberships, nil
 }
 
-func (p *Postgres) ShowActiveSegmentUser(user_id int64) ([]string, error) {
-	const op = "storage.postgres.users_table.ShowActiveSegmentUser"
+// existingUsers returns which of the users exist.
+func existingUsers(ctx context.Context, tx *sql.Tx, ids []int64) (map[int64]bool, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id FROM users WHERE id = ANY($1)", pq.Int64Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	if _, err := p.UserExists(user_id); err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+	existing := make(map[int64]bool, len(ids))
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		existing[id] = true
 	}
 
-	var segments pq.StringArray
-	err := p.usersTable.QueryRow(
-		"SELECT segments FROM users WHERE id = $1", user_id).Scan(&segments)
+	return existing, rows.Err()
+}
+
+type autoSegment struct {
+	id      int64
+	name    string
+	percent int
+}
+
+// autoSegments returns segments with automatic enrollment.
+func autoSegments(ctx context.Context, tx *sql.Tx) ([]autoSegment, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, name, auto_percent FROM segments WHERE auto_percent > 0 AND deleted_at IS NULL")
 	if err != nil {
-		return nil, fmt.Errorf("%s: %w", op, err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	var activeSegments []string
-	for _, segment := range segments {
-		activeSegments = append(activeSegments, segment)
+	var segments []autoSegment
+	for rows.Next() {
+		var segment autoSegment
+		if err := rows.Scan(&segment.id, &segment.name, &segment.percent); err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+
+	return segments, rows.Err()
+}
+
+// copyRows loads rows into the columns of table with COPY.
+func copyRows(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
+	if err != nil {
+		return err
+	}
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+
+	if _, err := stmt.ExecContext(ctx); err != nil {
+		stmt.Close()
+		return err
 	}
 
-	return activeSegments, nil
+	return stmt.Close()
 }
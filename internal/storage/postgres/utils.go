@@ -2,15 +2,23 @@ package postgres
 
 import (
 	"avito-internship/internal/storage"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+
+	"github.com/lib/pq"
 )
 
-func (p *Postgres) SegmentExists(segment string) (bool, error) {
+func (p *Postgres) SegmentExists(ctx context.Context, segment string) (_ bool, err error) {
 	const op = "storage.postgres.segments_table.SegmentExists"
 
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
 	var res bool
-	err := p.segmentsTable.QueryRow(
-		"SELECT EXISTS (SELECT 1 FROM segments WHERE name = $1)", segment).Scan(&res)
+	err = p.db.QueryRowContext(ctx,
+		"SELECT EXISTS (SELECT 1 FROM segments WHERE name = $1 AND deleted_at IS NULL)", segment).Scan(&res)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
 	}
@@ -18,11 +26,14 @@ func (p *Postgres) SegmentExists(segment string) (bool, error) {
 	return res, nil
 }
 
-func (p *Postgres) UserExists(user_id int64) (bool, error) {
+func (p *Postgres) UserExists(ctx context.Context, user_id int64) (_ bool, err error) {
 	const op = "storage.postgres.users_table.UserExists"
 
+	ctx, o := p.startOp(ctx, op)
+	defer o.end(&err)
+
 	var res bool
-	err := p.usersTable.QueryRow(
+	err = p.db.QueryRowContext(ctx,
 		"SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", user_id).Scan(&res)
 	if err != nil {
 		return false, fmt.Errorf("%s: %w", op, err)
@@ -31,39 +42,95 @@ func (p *Postgres) UserExists(user_id int64) (bool, error) {
 	return res, nil
 }
 
-func (p *Postgres) validateUserAndSegment(user_id int64, segments []string) error {
-	userExists, err := p.UserExists(user_id)
-	if err != nil {
-		return err
-	}
-	if !userExists {
+// lockUser locks the user row until the end of the transaction so that
+// concurrent membership changes of the same user are serialized.
+func lockUser(ctx context.Context, tx *sql.Tx, user_id int64) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", user_id).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
 		return storage.ErrUserNotFound
 	}
 
+	return err
+}
+
+// rolloutSelected is the condition of rollout.Selected for the SQL
+// expressions of the user id, the segment id and the percent.
+func rolloutSelected(userID, segment, percent string) string {
+	return fmt.Sprintf("('x' || substr(md5(%s::TEXT || ':' || %s::TEXT), 1, 8))::BIT(32)::BIGINT %% 100 < %s",
+		userID, segment, percent)
+}
+
+// segmentRef is a segment resolved from a slug.
+type segmentRef struct {
+	id int64
+	// name is the current name of the segment, which differs from the slug
+	// if the slug is an alias.
+	name string
+}
+
+// segmentIDs resolves segment slugs, as in GetSegment, to the segments.
+// It fails with storage.ErrSegmentNotFound if any of the segments does not
+// exist.
+func segmentIDs(ctx context.Context, tx *sql.Tx, segments []string) (map[string]segmentRef, error) {
+	ids, err := existingSegmentIDs(ctx, tx, segments)
+	if err != nil {
+		return nil, err
+	}
+
 	for _, segment := range segments {
-		segmentExists, err := p.SegmentExists(segment)
-		if err != nil {
-			return err
+		if _, ok := ids[segment]; !ok {
+			return nil, storage.ErrSegmentNotFound
 		}
-		if !segmentExists {
-			return storage.ErrSegmentNotFound
+	}
+
+	return ids, nil
+}
+
+// existingSegmentIDs resolves segment slugs, as in GetSegment, to the
+// segments by slug skipping the segments which do not exist. The segments
+// are locked against deletion until the end of the transaction, like by
+// lockSegment, so memberships are not added to a segment being deleted.
+func existingSegmentIDs(ctx context.Context, tx *sql.Tx, segments []string) (map[string]segmentRef, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT r.slug, s.id, s.name
+		FROM unnest($1::TEXT[]) AS r(slug)
+		JOIN segments s ON s.id = `+resolveSegment("r.slug")+`
+		WHERE s.deleted_at IS NULL
+		ORDER BY s.id
+		FOR SHARE OF s`,
+		pq.StringArray(segments))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make(map[string]segmentRef, len(segments))
+	for rows.Next() {
+		var (
+			slug string
+			ref  segmentRef
+		)
+		if err := rows.Scan(&slug, &ref.id, &ref.name); err != nil {
+			return nil, err
 		}
+		refs[slug] = ref
 	}
 
-	return nil
+	return refs, rows.Err()
 }
 
 func (p *Postgres) validateSegments(segments []string) ([]string, error) {
 	// Check that the list of segments is not empty.
 	if len(segments) == 0 {
-		return nil, fmt.Errorf("segments must not be empty")
+		return nil, storage.ErrNoSegments
 	}
 
 	// Check that the list of segments does not contain any duplicates.
 	uniqueSegments := make(map[string]bool)
 	for _, segment := range segments {
 		if uniqueSegments[segment] {
-			return nil, fmt.Errorf("segments must not contain any duplicates")
+			return nil, storage.ErrDuplicateSegments
 		}
 		uniqueSegments[segment] = true
 	}
@@ -1,11 +1,305 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"time"
 )
 
 var (
 	ErrUserNotFound    = errors.New("User not found")
+	ErrUserExists      = errors.New("User is exists")
 	ErrSegmentExists   = errors.New("Segment is exists")
 	ErrSegmentNotFound = errors.New("Segment not found")
+	ErrSegmentConflict = errors.New("Segment is both added and removed")
+	ErrAPIKeyNotFound  = errors.New("API key not found")
+	// ErrTimeout is returned when a storage operation runs out of its time.
+	ErrTimeout = errors.New("Storage operation timed out")
 )
+
+var (
+	ErrNoSegments        = &ValidationError{Reason: "segments must not be empty"}
+	ErrDuplicateSegments = &ValidationError{Reason: "segments must not contain any duplicates"}
+)
+
+// ValidationError is returned for input the storage does not accept. Unlike
+// other errors its text is shown to clients.
+type ValidationError struct {
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Reason
+}
+
+// Operations recorded in the membership history.
+const (
+	OperationAdd    = "add"
+	OperationRemove = "remove"
+	// OperationExpire marks an automatic removal of a membership whose TTL has passed.
+	OperationExpire = "expire"
+)
+
+// HistoryRecord is a single immutable entry of the membership history.
+type HistoryRecord struct {
+	UserID    int64
+	Segment   string
+	Operation string
+	// Actor is the subject who made the change, empty for changes made by
+	// the service itself, e.g. expiry.
+	Actor     string
+	CreatedAt time.Time
+}
+
+// Actions recorded in the segment audit trail.
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditRename = "rename"
+	AuditDelete = "delete"
+	// AuditRestore marks restoring a deleted segment.
+	AuditRestore = "restore"
+	// AuditPurge marks permanently removing a deleted segment.
+	AuditPurge = "purge"
+)
+
+// AuditRecord is a single immutable entry of the segment audit trail.
+type AuditRecord struct {
+	Segment string
+	Action  string
+	// PreviousName is the name a renamed segment had before, it is empty
+	// for other actions.
+	PreviousName string
+	Actor        string
+	CreatedAt    time.Time
+}
+
+// Stats are aggregate counters of the stored data.
+type Stats struct {
+	Segments int64
+	// Memberships counts not expired user memberships.
+	Memberships int64
+}
+
+// SegmentMeta is the editable description of a segment.
+type SegmentMeta struct {
+	Description string
+	// Owner is the team owning the segment.
+	Owner string
+	Tags  []string
+}
+
+// SegmentAlias is a former name of a renamed segment, which still resolves
+// to the segment until it expires.
+type SegmentAlias struct {
+	Name      string
+	ExpiresAt time.Time
+}
+
+// Segment is a segment with its properties.
+type Segment struct {
+	// ID is kept when the segment is renamed.
+	ID          int64
+	Name        string
+	AutoPercent int
+	SegmentMeta
+	// CreatedBy is the actor who created the segment.
+	CreatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Members is the number of active memberships, counted only if
+	// requested by SegmentFilter.WithMembers.
+	Members int64
+	// Aliases are the not expired former names ordered by expiry. They are
+	// returned only for a single segment, not by ListSegments.
+	Aliases []SegmentAlias
+}
+
+// Orders of the segment list.
+const (
+	SortByName      = "name"
+	SortByCreatedAt = "created_at"
+)
+
+// ImportedUser is a user created by ImportUsers.
+type ImportedUser struct {
+	UserID   int64
+	Segments []string
+}
+
+// MembersResult is the outcome of AddSegmentMembers and RemoveSegmentMembers.
+type MembersResult struct {
+	// Changed is the number of users added to or removed from the segment.
+	Changed int64
+	// Unchanged is the number of users already in the segment when adding
+	// or not in it when removing. Repeated users are counted here.
+	Unchanged int64
+	// Created is the number of users created, they are counted as Changed.
+	Created int64
+	// Unknown are the indexes of users which do not exist.
+	Unknown []int
+}
+
+// SegmentFilter selects a page of the segment list.
+type SegmentFilter struct {
+	// Sort is SortByName or SortByCreatedAt, ties are broken by name.
+	Sort string
+	Desc bool
+	// Prefix and Contains, if set, match the segment name.
+	Prefix   string
+	Contains string
+	// Tag and Owner, if set, select segments having the tag and owned by
+	// the team.
+	Tag   string
+	Owner string
+	// After, if set, is the last segment of the previous page: only
+	// segments following it in the sort order are returned.
+	After       *Segment
+	Limit       int
+	WithMembers bool
+}
+
+// APIKey is a key clients authenticate with. Only the hash of the key is stored.
+type APIKey struct {
+	ID        int64
+	Name      string
+	Scopes    []string
+	CreatedAt time.Time
+}
+
+// Store is the contract every storage backend of the service implements.
+type Store interface {
+	// CreateSegment creates a segment and enrolls autoPercent percent of users
+	// into it. It returns ErrSegmentExists if the segment or a not expired
+	// alias with the name already exists.
+	CreateSegment(ctx context.Context, segment string, autoPercent int, meta SegmentMeta) (int64, error)
+	// GetSegment returns the segment without its member count. slug is the
+	// name of the segment or its not expired alias.
+	// It returns ErrSegmentNotFound if the segment does not exist.
+	GetSegment(ctx context.Context, slug string) (Segment, error)
+	// SegmentsByAlias returns the segments named by the not expired aliases
+	// among slugs, by alias. Slugs which are segment names are skipped.
+	SegmentsByAlias(ctx context.Context, slugs []string) (map[string]Segment, error)
+	// UpdateSegment replaces the metadata of the segment named by slug, as
+	// in GetSegment, and returns it.
+	// It returns ErrSegmentNotFound if the segment does not exist.
+	UpdateSegment(ctx context.Context, slug string, meta SegmentMeta) (Segment, error)
+	// RenameSegment renames the segment named by slug, as in GetSegment,
+	// keeping its id and memberships. The former name becomes an alias
+	// until aliasExpiresAt. It returns ErrSegmentExists if another segment
+	// or its not expired alias has the new name.
+	RenameSegment(ctx context.Context, slug, name string, aliasExpiresAt time.Time) (Segment, error)
+	// DeleteSegment deletes the segment named by slug, as in GetSegment:
+	// it, its memberships and aliases are kept aside until purged, so that
+	// it can be restored. Users no longer have the segment and its name is
+	// free for new segments.
+	// It returns ErrSegmentNotFound if the segment does not exist.
+	DeleteSegment(ctx context.Context, slug string) (int64, error)
+	// RestoreSegment restores the latest segment deleted after deletedAfter
+	// whose name or not expired alias is slug, the name taking precedence,
+	// together with its not expired memberships.
+	// It returns ErrSegmentNotFound if there is no such segment and
+	// ErrSegmentExists if the name is taken, as in CreateSegment.
+	RestoreSegment(ctx context.Context, slug string, deletedAfter time.Time) (Segment, error)
+	// PurgeSegments permanently removes segments deleted before
+	// deletedBefore and returns their number.
+	PurgeSegments(ctx context.Context, deletedBefore time.Time) (int64, error)
+	// ListSegments returns up to filter.Limit segments matching filter.
+	ListSegments(ctx context.Context, filter SegmentFilter) ([]Segment, error)
+
+	// CreateUser creates a user with the given segments. Here and below
+	// segments of users are named by slugs, as in GetSegment.
+	// It returns ErrUserExists if the user already exists.
+	CreateUser(ctx context.Context, user_id int64, segments []string) error
+	UserExists(ctx context.Context, user_id int64) (bool, error)
+	// ImportUsers creates users like CreateUser, except that their segments
+	// may be empty. Users which cannot be created are skipped and their
+	// errors are returned by index in users: ErrUserExists if the user
+	// exists or repeats, ErrSegmentNotFound if a segment does not exist.
+	// The other users are created in a single transaction. With dryRun the
+	// users are only checked.
+	ImportUsers(ctx context.Context, users []ImportedUser, dryRun bool) (map[int]error, error)
+
+	// AddUserToSegment adds the user to segments, optionally with expiry
+	// time per segment. Adding an existing membership only updates its expiry.
+	AddUserToSegment(ctx context.Context, user_id int64, segments []string, expires map[string]time.Time) error
+	RemoveSegmentsFromUser(ctx context.Context, user_id int64, segments []string) error
+	// UpdateUserSegments atomically adds and removes user segments and returns
+	// the resulting active segments. Either all changes apply or none.
+	// Existing memberships being added keep their expiry.
+	// It returns ErrSegmentConflict if a segment is both added and removed.
+	UpdateUserSegments(ctx context.Context, user_id int64, add, remove []string) ([]string, error)
+	// AddSegmentMembers adds users to the segment with the id in a single
+	// transaction. Existing memberships are kept as they are, including
+	// their expiry. Users which do not exist are created like by
+	// CreateUser if createMissing and reported as unknown otherwise.
+	// It returns ErrSegmentNotFound if the segment does not exist.
+	AddSegmentMembers(ctx context.Context, segmentID int64, users []int64, createMissing bool) (MembersResult, error)
+	// RemoveSegmentMembers removes users from the segment with the id in a
+	// single transaction. It returns ErrSegmentNotFound if the segment does
+	// not exist.
+	RemoveSegmentMembers(ctx context.Context, segmentID int64, users []int64) (MembersResult, error)
+	// ShowActiveSegmentUser returns not expired segments of the user ordered by name.
+	ShowActiveSegmentUser(ctx context.Context, user_id int64) ([]string, error)
+	// RemoveExpiredSegments removes memberships expired by now.
+	RemoveExpiredSegments(ctx context.Context, now time.Time) (int64, error)
+
+	// History calls fn for every membership change made in [from, to)
+	// ordered by time without loading them all at once. It stops at the
+	// first error returned by fn and returns it.
+	History(ctx context.Context, from, to time.Time, fn func(HistoryRecord) error) error
+	// SegmentAudit returns segment changes made in [from, to) ordered by time.
+	SegmentAudit(ctx context.Context, from, to time.Time) ([]AuditRecord, error)
+
+	// CreateAPIKey stores a key with the given hash and returns its id.
+	CreateAPIKey(ctx context.Context, name string, hash []byte, scopes []string) (int64, error)
+	// APIKeyByHash returns the not revoked key with the given hash.
+	// It returns ErrAPIKeyNotFound if there is no such key.
+	APIKeyByHash(ctx context.Context, hash []byte) (APIKey, error)
+	// RotateAPIKey replaces the hash of the not revoked key, so the old key
+	// stops working. It returns ErrAPIKeyNotFound if there is no such key.
+	RotateAPIKey(ctx context.Context, id int64, hash []byte) error
+	// RevokeAPIKey revokes the key. It returns ErrAPIKeyNotFound if there
+	// is no such key or it is already revoked.
+	RevokeAPIKey(ctx context.Context, id int64) error
+
+	// Stats returns the number of segments and active memberships.
+	Stats(ctx context.Context) (Stats, error)
+
+	// Ping checks the store is reachable.
+	Ping(ctx context.Context) error
+	// Close releases resources held by the store.
+	Close() error
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the subject recorded as the
+// author of changes made with it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor stored by WithActor or an empty string.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// CheckSegmentsConflict returns ErrSegmentConflict if a segment is both
+// in add and remove.
+func CheckSegmentsConflict(add, remove []string) error {
+	added := make(map[string]bool, len(add))
+	for _, segment := range add {
+		added[segment] = true
+	}
+
+	for _, segment := range remove {
+		if added[segment] {
+			return fmt.Errorf("%w: %s", ErrSegmentConflict, segment)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,1265 @@
+// Package storagetest contains the conformance suite every storage.Store
+// implementation must pass.
+package storagetest
+
+import (
+	"avito-internship/internal/lib/rollout"
+	"avito-internship/internal/storage"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty store. It is called once per test case.
+type Factory func(t *testing.T) storage.Store
+
+// Run runs the conformance suite against stores created by newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s storage.Store)
+	}{
+		{"CreateSegment", testCreateSegment},
+		{"CreateSegmentDuplicate", testCreateSegmentDuplicate},
+		{"DeleteSegment", testDeleteSegment},
+		{"DeleteSegmentNotFound", testDeleteSegmentNotFound},
+		{"RestoreSegment", testRestoreSegment},
+		{"RestoreSegmentConflict", testRestoreSegmentConflict},
+		{"PurgeSegments", testPurgeSegments},
+		{"ListSegments", testListSegments},
+		{"ListSegmentsByCreatedAt", testListSegmentsByCreatedAt},
+		{"ListSegmentsByMeta", testListSegmentsByMeta},
+		{"SegmentMeta", testSegmentMeta},
+		{"SegmentMetaNotFound", testSegmentMetaNotFound},
+		{"RenameSegment", testRenameSegment},
+		{"RenameSegmentConflict", testRenameSegmentConflict},
+		{"RenameSegmentAliasExpiry", testRenameSegmentAliasExpiry},
+		{"SegmentAliases", testSegmentAliases},
+		{"CreateUser", testCreateUser},
+		{"CreateUserDuplicate", testCreateUserDuplicate},
+		{"CreateUserUnknownSegment", testCreateUserUnknownSegment},
+		{"CreateUserInvalidSegments", testCreateUserInvalidSegments},
+		{"ImportUsers", testImportUsers},
+		{"AddUserToSegment", testAddUserToSegment},
+		{"AddUserToSegmentNotFound", testAddUserToSegmentNotFound},
+		{"RemoveSegmentsFromUser", testRemoveSegmentsFromUser},
+		{"RemoveSegmentsFromUserNotFound", testRemoveSegmentsFromUserNotFound},
+		{"AddSegmentMembers", testAddSegmentMembers},
+		{"RemoveSegmentMembers", testRemoveSegmentMembers},
+		{"UpdateUserSegments", testUpdateUserSegments},
+		{"UpdateUserSegmentsAtomic", testUpdateUserSegmentsAtomic},
+		{"UpdateUserSegmentsConflict", testUpdateUserSegmentsConflict},
+		{"ShowActiveSegmentUserNotFound", testShowActiveSegmentUserNotFound},
+		{"Expiry", testExpiry},
+		{"AutoPercent", testAutoPercent},
+		{"AutoPercentRename", testAutoPercentRename},
+		{"History", testHistory},
+		{"HistoryActor", testHistoryActor},
+		{"SegmentAudit", testSegmentAudit},
+		{"Stats", testStats},
+		{"APIKeys", testAPIKeys},
+		{"APIKeyNotFound", testAPIKeyNotFound},
+		{"ConcurrentCreateSegment", testConcurrentCreateSegment},
+		{"ConcurrentMemberships", testConcurrentMemberships},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func testCreateSegment(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	first, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	second, err := s.CreateSegment(ctx, "AVITO_DISCOUNT_30", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+}
+
+func testCreateSegmentDuplicate(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	_, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	_, err = s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.ErrorIs(t, err, storage.ErrSegmentExists)
+}
+
+func testDeleteSegment(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	mustCreateSegments(t, s, "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(ctx, 1, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+
+	deleted, err := s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+	require.Equal(t, id, deleted)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30"}, segments)
+
+	// The slug is free again once the segment is deleted.
+	_, err = s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	segments, err = s.ShowActiveSegmentUser(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30"}, segments)
+}
+
+func testDeleteSegmentNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	_, err := s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testRestoreSegment(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{Owner: "messenger"})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, s.CreateUser(ctx, 1001, []string{"AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, s.AddUserToSegment(ctx, 1001, []string{"AVITO_VOICE_MESSAGES"}, map[string]time.Time{
+		"AVITO_VOICE_MESSAGES": time.Now().Add(time.Second),
+	}))
+
+	_, err = s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	// The deleted segment is hidden everywhere.
+	_, err = s.GetSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	err = s.AddUserToSegment(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}, nil)
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	page, err := s.ListSegments(ctx, storage.SegmentFilter{Limit: 10})
+	require.NoError(t, err)
+	require.Empty(t, page)
+
+	stats, err := s.Stats(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, stats.Segments)
+
+	// Segments deleted before the window are not restored.
+	_, err = s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	// Let the membership of 1001 expire while the segment is deleted.
+	time.Sleep(time.Second)
+
+	segment, err := s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, id, segment.ID)
+	require.Equal(t, "messenger", segment.Owner)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+
+	segments, err = s.ShowActiveSegmentUser(ctx, 1001)
+	require.NoError(t, err)
+	require.Empty(t, segments)
+
+	_, err = s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	records, err := s.SegmentAudit(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, storage.AuditRestore, records[2].Action)
+	require.Equal(t, "user:alice", records[2].Actor)
+
+	history, err := collectHistory(ctx, s, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, storage.OperationAdd, history[len(history)-1].Operation)
+	require.EqualValues(t, 1000, history[len(history)-1].UserID)
+}
+
+func testRestoreSegmentConflict(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	first, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	_, err = s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	second, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	_, err = s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentExists)
+
+	_, err = s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	// The latest deleted segment is restored.
+	segment, err := s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, second, segment.ID)
+	require.NotEqual(t, first, segment.ID)
+}
+
+func testPurgeSegments(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	_, err := s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	purged, err := s.PurgeSegments(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, purged)
+
+	purged, err = s.PurgeSegments(ctx, time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, purged)
+
+	_, err = s.RestoreSegment(ctx, "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	// Active segments are never purged.
+	_, err = s.GetSegment(ctx, "AVITO_DISCOUNT_30")
+	require.NoError(t, err)
+
+	records, err := s.SegmentAudit(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, storage.AuditPurge, records[len(records)-1].Action)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[len(records)-1].Segment)
+}
+
+func testListSegments(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "OTHER_DISCOUNT")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_DISCOUNT_30", "OTHER_DISCOUNT"}))
+	require.NoError(t, s.CreateUser(ctx, 1001, []string{"AVITO_DISCOUNT_30"}))
+
+	page, err := s.ListSegments(ctx, storage.SegmentFilter{Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 2, After: &page[1]})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES", "OTHER_DISCOUNT"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 2, After: &page[1]})
+	require.NoError(t, err)
+	require.Empty(t, page)
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Desc: true, Prefix: "AVITO_"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"}, names(page))
+
+	// Wildcards are matched literally.
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Contains: "_DISCOUNT"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "OTHER_DISCOUNT"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Contains: "%"})
+	require.NoError(t, err)
+	require.Empty(t, page)
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 2, WithMembers: true})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, page[0].Members)
+	require.EqualValues(t, 0, page[1].Members)
+	require.False(t, page[0].CreatedAt.IsZero())
+}
+
+func testListSegmentsByCreatedAt(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "C", "A", "B")
+
+	page, err := s.ListSegments(ctx, storage.SegmentFilter{Sort: storage.SortByCreatedAt, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"C", "A"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Sort: storage.SortByCreatedAt, Limit: 2, After: &page[1]})
+	require.NoError(t, err)
+	require.Equal(t, []string{"B"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Sort: storage.SortByCreatedAt, Desc: true, Limit: 10})
+	require.NoError(t, err)
+	require.Equal(t, []string{"B", "A", "C"}, names(page))
+}
+
+func testListSegmentsByMeta(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	for name, meta := range map[string]storage.SegmentMeta{
+		"AVITO_VOICE_MESSAGES": {Owner: "messenger", Tags: []string{"voice", "experiment"}},
+		"AVITO_DISCOUNT_30":    {Owner: "pricing", Tags: []string{"discount", "experiment"}},
+		"AVITO_DISCOUNT_50":    {Owner: "pricing", Tags: []string{"discount"}},
+	} {
+		_, err := s.CreateSegment(ctx, name, 0, meta)
+		require.NoError(t, err)
+	}
+
+	page, err := s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Tag: "experiment"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES"}, names(page))
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Owner: "pricing", Tag: "discount"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, names(page))
+	require.Equal(t, []string{"discount", "experiment"}, page[0].Tags)
+
+	page, err = s.ListSegments(ctx, storage.SegmentFilter{Limit: 10, Owner: "messenger", Tag: "discount"})
+	require.NoError(t, err)
+	require.Empty(t, page)
+}
+
+func testSegmentMeta(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	_, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 10, storage.SegmentMeta{
+		Description: "Voice messages in chats",
+		Owner:       "messenger",
+		Tags:        []string{"voice"},
+	})
+	require.NoError(t, err)
+
+	segment, err := s.GetSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+	require.Equal(t, 10, segment.AutoPercent)
+	require.Equal(t, "Voice messages in chats", segment.Description)
+	require.Equal(t, "messenger", segment.Owner)
+	require.Equal(t, []string{"voice"}, segment.Tags)
+	require.Equal(t, "user:alice", segment.CreatedBy)
+	require.False(t, segment.CreatedAt.IsZero())
+
+	updated, err := s.UpdateSegment(storage.WithActor(context.Background(), "user:bob"), "AVITO_VOICE_MESSAGES", storage.SegmentMeta{
+		Owner: "chats",
+	})
+	require.NoError(t, err)
+	require.Empty(t, updated.Description)
+	require.Equal(t, "chats", updated.Owner)
+	require.Empty(t, updated.Tags)
+	require.Equal(t, "user:alice", updated.CreatedBy)
+	require.True(t, segment.CreatedAt.Equal(updated.CreatedAt))
+	require.False(t, updated.UpdatedAt.Before(segment.UpdatedAt))
+
+	segment, err = s.GetSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+	require.Equal(t, "chats", segment.Owner)
+
+	records, err := s.SegmentAudit(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, storage.AuditUpdate, records[1].Action)
+	require.Equal(t, "user:bob", records[1].Actor)
+}
+
+func testSegmentMetaNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	_, err := s.GetSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	_, err = s.UpdateSegment(ctx, "AVITO_VOICE_MESSAGES", storage.SegmentMeta{Owner: "messenger"})
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testRenameSegment(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE", 0, storage.SegmentMeta{Owner: "messenger"})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE"}))
+
+	aliasExpiresAt := time.Now().Add(time.Hour)
+	segment, err := s.RenameSegment(ctx, "AVITO_VOICE", "AVITO_VOICE_MESSAGES", aliasExpiresAt)
+	require.NoError(t, err)
+	require.Equal(t, id, segment.ID)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+	require.Equal(t, "messenger", segment.Owner)
+	require.Len(t, segment.Aliases, 1)
+	require.Equal(t, "AVITO_VOICE", segment.Aliases[0].Name)
+	require.WithinDuration(t, aliasExpiresAt, segment.Aliases[0].ExpiresAt, time.Second)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+
+	// The former name resolves to the renamed segment.
+	segment, err = s.GetSegment(ctx, "AVITO_VOICE")
+	require.NoError(t, err)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+
+	segment, err = s.UpdateSegment(ctx, "AVITO_VOICE", storage.SegmentMeta{Owner: "chats"})
+	require.NoError(t, err)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+	require.Equal(t, "chats", segment.Owner)
+
+	// Renaming back to the former name drops the alias.
+	segment, err = s.RenameSegment(ctx, "AVITO_VOICE_MESSAGES", "AVITO_VOICE", aliasExpiresAt)
+	require.NoError(t, err)
+	require.Equal(t, id, segment.ID)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, aliasNames(segment.Aliases))
+
+	records, err := s.SegmentAudit(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, storage.AuditRename, records[1].Action)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[1].Segment)
+	require.Equal(t, "AVITO_VOICE", records[1].PreviousName)
+	require.Equal(t, "user:alice", records[1].Actor)
+
+	// The history keeps the names the segment had.
+	history, err := collectHistory(ctx, s, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, "AVITO_VOICE", history[0].Segment)
+
+	_, err = s.DeleteSegment(ctx, "AVITO_VOICE")
+	require.NoError(t, err)
+
+	_, err = s.GetSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testRenameSegmentConflict(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+
+	_, err := s.RenameSegment(ctx, "AVITO_VOICE", "AVITO_DISCOUNT_30", time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentExists)
+
+	_, err = s.RenameSegment(ctx, "AVITO_DISCOUNT_30", "AVITO_DISCOUNT", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	// A not expired alias still refers to its segment.
+	_, err = s.RenameSegment(ctx, "AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30", time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentExists)
+
+	_, err = s.CreateSegment(ctx, "AVITO_DISCOUNT_30", 0, storage.SegmentMeta{})
+	require.ErrorIs(t, err, storage.ErrSegmentExists)
+
+	_, err = s.RenameSegment(ctx, "AVITO_UNKNOWN", "AVITO_NEW", time.Now().Add(time.Hour))
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	// Renaming to the current name changes nothing.
+	segment, err := s.RenameSegment(ctx, "AVITO_VOICE", "AVITO_VOICE", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, "AVITO_VOICE", segment.Name)
+	require.Empty(t, segment.Aliases)
+}
+
+func testRenameSegmentAliasExpiry(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE")
+
+	segment, err := s.RenameSegment(ctx, "AVITO_VOICE", "AVITO_VOICE_MESSAGES", time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	require.Empty(t, segment.Aliases)
+
+	_, err = s.GetSegment(ctx, "AVITO_VOICE")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	// The expired alias no longer reserves the name.
+	_, err = s.CreateSegment(ctx, "AVITO_VOICE", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	segment, err = s.GetSegment(ctx, "AVITO_VOICE")
+	require.NoError(t, err)
+	require.Equal(t, "AVITO_VOICE", segment.Name)
+}
+
+func testSegmentAliases(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	mustCreateSegments(t, s, "AVITO_DISCOUNT_30")
+	_, err = s.RenameSegment(ctx, "AVITO_VOICE", "AVITO_VOICE_MESSAGES", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	aliases, err := s.SegmentsByAlias(ctx, []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES", "AVITO_UNKNOWN"})
+	require.NoError(t, err)
+	require.Len(t, aliases, 1)
+	require.Equal(t, id, aliases["AVITO_VOICE"].ID)
+	require.Equal(t, []string{"AVITO_VOICE"}, aliasNames(aliases["AVITO_VOICE"].Aliases))
+
+	// Users refer to the segment by its former name as well, a segment
+	// named both ways is added once.
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES"}))
+	requireActiveSegments(t, s, 1000, "AVITO_VOICE_MESSAGES")
+
+	require.NoError(t, s.CreateUser(ctx, 1001, []string{"AVITO_DISCOUNT_30"}))
+	require.NoError(t, s.AddUserToSegment(ctx, 1001, []string{"AVITO_VOICE"}, map[string]time.Time{
+		"AVITO_VOICE": time.Now().Add(time.Hour),
+	}))
+	requireActiveSegments(t, s, 1001, "AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES")
+
+	require.NoError(t, s.RemoveSegmentsFromUser(ctx, 1001, []string{"AVITO_VOICE"}))
+	requireActiveSegments(t, s, 1001, "AVITO_DISCOUNT_30")
+
+	_, err = s.UpdateUserSegments(ctx, 1001, []string{"AVITO_VOICE"}, []string{"AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrSegmentConflict)
+
+	segments, err := s.UpdateUserSegments(ctx, 1001, []string{"AVITO_VOICE"}, []string{"AVITO_DISCOUNT_30"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+
+	failed, err := s.ImportUsers(ctx, []storage.ImportedUser{
+		{UserID: 1002, Segments: []string{"AVITO_VOICE"}},
+		{UserID: 1003, Segments: []string{"AVITO_VOICE", "AVITO_VOICE_MESSAGES"}},
+	}, false)
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	require.ErrorIs(t, failed[1], storage.ErrDuplicateSegments)
+	requireActiveSegments(t, s, 1002, "AVITO_VOICE_MESSAGES")
+
+	// The history names the segment by its name, not by the alias used.
+	history, err := collectHistory(ctx, s, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	for _, record := range history {
+		require.NotEqual(t, "AVITO_VOICE", record.Segment)
+	}
+
+	// The segment is deleted and restored by the alias, which is kept
+	// meanwhile but does not resolve.
+	deleted, err := s.DeleteSegment(ctx, "AVITO_VOICE")
+	require.NoError(t, err)
+	require.Equal(t, id, deleted)
+
+	_, err = s.GetSegment(ctx, "AVITO_VOICE")
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	aliases, err = s.SegmentsByAlias(ctx, []string{"AVITO_VOICE"})
+	require.NoError(t, err)
+	require.Empty(t, aliases)
+
+	segment, err := s.RestoreSegment(ctx, "AVITO_VOICE", time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, id, segment.ID)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", segment.Name)
+	require.Equal(t, []string{"AVITO_VOICE"}, aliasNames(segment.Aliases))
+	requireActiveSegments(t, s, 1000, "AVITO_VOICE_MESSAGES")
+
+	records, err := s.SegmentAudit(ctx, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, storage.AuditDelete, records[len(records)-2].Action)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[len(records)-2].Segment)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[len(records)-1].Segment)
+}
+
+func testCreateUser(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+
+	exists, err := s.UserExists(ctx, 1000)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+
+	exists, err = s.UserExists(ctx, 1000)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_VOICE_MESSAGES"}, segments)
+}
+
+func testCreateUserDuplicate(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	err := s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrUserExists)
+}
+
+func testCreateUserUnknownSegment(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	err := s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	exists, err := s.UserExists(ctx, 1000)
+	require.NoError(t, err)
+	require.False(t, exists, "failed user creation must not leave the user behind")
+}
+
+func testCreateUserInvalidSegments(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+
+	err := s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrDuplicateSegments)
+
+	err = s.CreateUser(ctx, 1000, nil)
+	require.ErrorIs(t, err, storage.ErrNoSegments)
+
+	var validationErr *storage.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+}
+
+func testImportUsers(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+	_, err := s.CreateSegment(ctx, "AVITO_PERFORMANCE_VAS", 100, storage.SegmentMeta{})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	users := []storage.ImportedUser{
+		{UserID: 1001, Segments: []string{"AVITO_VOICE_MESSAGES"}},
+		{UserID: 1000},
+		{UserID: 1002, Segments: []string{"AVITO_DISCOUNT_30"}},
+		{UserID: 1003, Segments: []string{"AVITO_VOICE_MESSAGES", "AVITO_VOICE_MESSAGES"}},
+		{UserID: 1001},
+		{UserID: 1004},
+	}
+
+	check := func(failed map[int]error) {
+		t.Helper()
+
+		require.Len(t, failed, 4)
+		require.ErrorIs(t, failed[1], storage.ErrUserExists)
+		require.ErrorIs(t, failed[2], storage.ErrSegmentNotFound)
+		require.ErrorIs(t, failed[3], storage.ErrDuplicateSegments)
+		require.ErrorIs(t, failed[4], storage.ErrUserExists)
+	}
+
+	failed, err := s.ImportUsers(ctx, users, true)
+	require.NoError(t, err)
+	check(failed)
+
+	exists, err := s.UserExists(ctx, 1001)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	from := time.Now().Add(-time.Hour)
+
+	failed, err = s.ImportUsers(ctx, users, false)
+	require.NoError(t, err)
+	check(failed)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1001)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_PERFORMANCE_VAS", "AVITO_VOICE_MESSAGES"}, segments)
+
+	segments, err = s.ShowActiveSegmentUser(ctx, 1004)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_PERFORMANCE_VAS"}, segments)
+
+	for _, user := range []int64{1002, 1003} {
+		exists, err := s.UserExists(ctx, user)
+		require.NoError(t, err)
+		require.False(t, exists)
+	}
+
+	records, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	imported := 0
+	for _, record := range records {
+		if record.UserID == 1001 || record.UserID == 1004 {
+			imported++
+			require.Equal(t, storage.OperationAdd, record.Operation)
+			require.Equal(t, "user:alice", record.Actor)
+		}
+	}
+	require.Equal(t, 3, imported)
+}
+
+func testAddUserToSegment(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_50", "AVITO_DISCOUNT_30"}, nil))
+	// Adding an existing membership again is not an error.
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, nil))
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"}, segments)
+}
+
+func testAddUserToSegmentNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+
+	err := s.AddUserToSegment(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}, nil)
+	require.ErrorIs(t, err, storage.ErrUserNotFound)
+
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	err = s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, nil)
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testRemoveSegmentsFromUser(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+
+	// Removing a segment the user is not in is not an error.
+	require.NoError(t, s.RemoveSegmentsFromUser(ctx, 1000, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}))
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+}
+
+func testRemoveSegmentsFromUserNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+
+	err := s.RemoveSegmentsFromUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrUserNotFound)
+
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	err = s.RemoveSegmentsFromUser(ctx, 1000, []string{"AVITO_DISCOUNT_30"})
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testAddSegmentMembers(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	_, err = s.CreateSegment(ctx, "AVITO_PERFORMANCE_VAS", 100, storage.SegmentMeta{})
+	require.NoError(t, err)
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}, map[string]time.Time{
+		"AVITO_VOICE_MESSAGES": time.Now().Add(time.Hour),
+	}))
+	require.NoError(t, s.CreateUser(ctx, 1001, []string{"AVITO_PERFORMANCE_VAS"}))
+
+	from := time.Now().Add(-time.Hour)
+	before, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	res, err := s.AddSegmentMembers(ctx, id, []int64{1000, 1001, 1002, 1001}, false)
+	require.NoError(t, err)
+	require.Equal(t, storage.MembersResult{Changed: 1, Unchanged: 2, Unknown: []int{2}}, res)
+
+	res, err = s.AddSegmentMembers(ctx, id, []int64{1002, 1003}, true)
+	require.NoError(t, err)
+	require.Equal(t, storage.MembersResult{Changed: 2, Created: 2}, res)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1002)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_PERFORMANCE_VAS", "AVITO_VOICE_MESSAGES"}, segments)
+
+	records, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	var added []string
+	for _, record := range records[len(before):] {
+		require.Equal(t, storage.OperationAdd, record.Operation)
+		require.Equal(t, "user:alice", record.Actor)
+		added = append(added, fmt.Sprintf("%d:%s", record.UserID, record.Segment))
+	}
+	require.ElementsMatch(t, []string{
+		"1001:AVITO_VOICE_MESSAGES",
+		"1002:AVITO_VOICE_MESSAGES",
+		"1002:AVITO_PERFORMANCE_VAS",
+		"1003:AVITO_VOICE_MESSAGES",
+		"1003:AVITO_PERFORMANCE_VAS",
+	}, added)
+
+	// Adding the user again keeps the expiry of its membership.
+	removed, err := s.RemoveExpiredSegments(ctx, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), removed)
+
+	_, err = s.DeleteSegment(ctx, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	_, err = s.AddSegmentMembers(ctx, id, []int64{1000}, false)
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testRemoveSegmentMembers(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	id, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	mustCreateSegments(t, s, "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+	require.NoError(t, s.CreateUser(ctx, 1001, []string{"AVITO_DISCOUNT_30"}))
+
+	from := time.Now().Add(-time.Hour)
+	before, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	res, err := s.RemoveSegmentMembers(ctx, id, []int64{1000, 1001, 1002, 1000})
+	require.NoError(t, err)
+	require.Equal(t, storage.MembersResult{Changed: 1, Unchanged: 2, Unknown: []int{2}}, res)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30"}, segments)
+
+	records, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	records = records[len(before):]
+	require.Len(t, records, 1)
+	require.Equal(t, storage.OperationRemove, records[0].Operation)
+	require.EqualValues(t, 1000, records[0].UserID)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[0].Segment)
+
+	_, err = s.RemoveSegmentMembers(ctx, id+100, []int64{1000})
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+}
+
+func testUpdateUserSegments(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+
+	segments, err := s.UpdateUserSegments(ctx, 1000, []string{"AVITO_DISCOUNT_50"}, []string{"AVITO_DISCOUNT_30"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"}, segments)
+
+	active, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, segments, active)
+}
+
+func testUpdateUserSegmentsAtomic(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	_, err := s.UpdateUserSegments(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, []string{"AVITO_VOICE_MESSAGES", "AVITO_UNKNOWN"})
+	require.ErrorIs(t, err, storage.ErrSegmentNotFound)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments, "failed update must not apply any change")
+
+	_, err = s.UpdateUserSegments(ctx, 2000, []string{"AVITO_DISCOUNT_30"}, nil)
+	require.ErrorIs(t, err, storage.ErrUserNotFound)
+}
+
+func testUpdateUserSegmentsConflict(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	_, err := s.UpdateUserSegments(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}, []string{"AVITO_VOICE_MESSAGES"})
+	require.ErrorIs(t, err, storage.ErrSegmentConflict)
+}
+
+func testShowActiveSegmentUserNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	_, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.ErrorIs(t, err, storage.ErrUserNotFound)
+}
+
+func testExpiry(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+
+	now := time.Now()
+	err := s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50"}, map[string]time.Time{
+		"AVITO_DISCOUNT_30": now.Add(-time.Minute),
+		"AVITO_DISCOUNT_50": now.Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	segments, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"}, segments)
+
+	removed, err := s.RemoveExpiredSegments(ctx, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, removed)
+
+	removed, err = s.RemoveExpiredSegments(ctx, now)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, removed)
+
+	records, err := collectHistory(ctx, s, now.Add(-time.Hour), now.Add(time.Hour))
+	require.NoError(t, err)
+	require.Contains(t, operations(records), "1000 AVITO_DISCOUNT_30 "+storage.OperationExpire)
+
+	// Updating the segments of the user keeps the expiry of memberships
+	// being added again.
+	segments, err = s.UpdateUserSegments(ctx, 1000, []string{"AVITO_DISCOUNT_50"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_50", "AVITO_VOICE_MESSAGES"}, segments)
+
+	removed, err = s.RemoveExpiredSegments(ctx, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, removed)
+
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_50"}, map[string]time.Time{
+		"AVITO_DISCOUNT_50": now.Add(time.Hour),
+	}))
+
+	// Adding a membership again without expiry makes it permanent.
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_50"}, nil))
+
+	removed, err = s.RemoveExpiredSegments(ctx, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, removed)
+}
+
+func testAutoPercent(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	const percent = 50
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+	for user_id := int64(1); user_id <= 20; user_id++ {
+		require.NoError(t, s.CreateUser(ctx, user_id, []string{"AVITO_VOICE_MESSAGES"}))
+	}
+
+	id, err := s.CreateSegment(ctx, "AVITO_PERCENT", percent, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	for user_id := int64(21); user_id <= 40; user_id++ {
+		require.NoError(t, s.CreateUser(ctx, user_id, []string{"AVITO_VOICE_MESSAGES"}))
+	}
+
+	for user_id := int64(1); user_id <= 40; user_id++ {
+		segments, err := s.ShowActiveSegmentUser(ctx, user_id)
+		require.NoError(t, err)
+
+		if rollout.Selected(user_id, id, percent) {
+			require.Contains(t, segments, "AVITO_PERCENT", "user %d", user_id)
+		} else {
+			require.NotContains(t, segments, "AVITO_PERCENT", "user %d", user_id)
+		}
+	}
+}
+
+func testAutoPercentRename(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	const percent = 50
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES")
+	id, err := s.CreateSegment(ctx, "AVITO_PERCENT", percent, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	requireSelected := func(from, to int64) {
+		t.Helper()
+
+		for user_id := from; user_id <= to; user_id++ {
+			require.NoError(t, s.CreateUser(ctx, user_id, []string{"AVITO_VOICE_MESSAGES"}))
+
+			segments, err := s.ShowActiveSegmentUser(ctx, user_id)
+			require.NoError(t, err)
+			require.Equal(t, rollout.Selected(user_id, id, percent), len(segments) == 2, "user %d", user_id)
+		}
+	}
+
+	requireSelected(1, 20)
+
+	_, err = s.RenameSegment(ctx, "AVITO_PERCENT", "AVITO_PERCENT_V2", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	// Users created after the rename are selected by the same rule.
+	requireSelected(21, 40)
+}
+
+func testHistory(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	from := time.Now().Add(-time.Hour)
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, nil))
+	require.NoError(t, s.RemoveSegmentsFromUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	_, err := s.DeleteSegment(ctx, "AVITO_DISCOUNT_30")
+	require.NoError(t, err)
+
+	records, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"1000 AVITO_VOICE_MESSAGES " + storage.OperationAdd,
+		"1000 AVITO_DISCOUNT_30 " + storage.OperationAdd,
+		"1000 AVITO_VOICE_MESSAGES " + storage.OperationRemove,
+		"1000 AVITO_DISCOUNT_30 " + storage.OperationRemove,
+	}, operations(records))
+
+	records, err = collectHistory(ctx, s, from.Add(-time.Hour), from)
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
+
+func testHistoryActor(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	from := time.Now().Add(-time.Hour)
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30")
+	require.NoError(t, s.CreateUser(context.Background(), 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	require.NoError(t, s.AddUserToSegment(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, nil))
+
+	records, err := collectHistory(ctx, s, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Empty(t, records[0].Actor)
+	require.Equal(t, "user:alice", records[1].Actor)
+}
+
+func testSegmentAudit(t *testing.T, s storage.Store) {
+	ctx := storage.WithActor(context.Background(), "user:alice")
+
+	from := time.Now().Add(-time.Hour)
+
+	_, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+	_, err = s.DeleteSegment(storage.WithActor(ctx, "api-key:1"), "AVITO_VOICE_MESSAGES")
+	require.NoError(t, err)
+
+	records, err := s.SegmentAudit(ctx, from, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "AVITO_VOICE_MESSAGES", records[0].Segment)
+	require.Equal(t, storage.AuditCreate, records[0].Action)
+	require.Equal(t, "user:alice", records[0].Actor)
+	require.Equal(t, storage.AuditDelete, records[1].Action)
+	require.Equal(t, "api-key:1", records[1].Actor)
+
+	records, err = s.SegmentAudit(ctx, from.Add(-time.Hour), from)
+	require.NoError(t, err)
+	require.Empty(t, records)
+}
+
+func testStats(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	stats, err := s.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stats{}, stats)
+
+	mustCreateSegments(t, s, "AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30", "AVITO_DISCOUNT_50")
+	require.NoError(t, s.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES", "AVITO_DISCOUNT_30"}))
+	require.NoError(t, s.CreateUser(ctx, 1002, []string{"AVITO_VOICE_MESSAGES"}))
+
+	// Expired memberships are not counted.
+	err = s.AddUserToSegment(ctx, 1002, []string{"AVITO_DISCOUNT_50"}, map[string]time.Time{
+		"AVITO_DISCOUNT_50": time.Now().Add(-time.Minute),
+	})
+	require.NoError(t, err)
+
+	stats, err = s.Stats(ctx)
+	require.NoError(t, err)
+	require.Equal(t, storage.Stats{Segments: 3, Memberships: 3}, stats)
+}
+
+func testAPIKeys(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	id, err := s.CreateAPIKey(ctx, "batch-job", []byte("hash-1"), []string{"segments:read", "users:write"})
+	require.NoError(t, err)
+
+	key, err := s.APIKeyByHash(ctx, []byte("hash-1"))
+	require.NoError(t, err)
+	require.Equal(t, id, key.ID)
+	require.Equal(t, "batch-job", key.Name)
+	require.Equal(t, []string{"segments:read", "users:write"}, key.Scopes)
+
+	// After rotation only the new hash is accepted.
+	require.NoError(t, s.RotateAPIKey(ctx, id, []byte("hash-2")))
+
+	_, err = s.APIKeyByHash(ctx, []byte("hash-1"))
+	require.ErrorIs(t, err, storage.ErrAPIKeyNotFound)
+
+	key, err = s.APIKeyByHash(ctx, []byte("hash-2"))
+	require.NoError(t, err)
+	require.Equal(t, id, key.ID)
+
+	require.NoError(t, s.RevokeAPIKey(ctx, id))
+
+	_, err = s.APIKeyByHash(ctx, []byte("hash-2"))
+	require.ErrorIs(t, err, storage.ErrAPIKeyNotFound)
+}
+
+func testAPIKeyNotFound(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	_, err := s.APIKeyByHash(ctx, []byte("unknown"))
+	require.ErrorIs(t, err, storage.ErrAPIKeyNotFound)
+
+	require.ErrorIs(t, s.RotateAPIKey(ctx, 42, []byte("hash")), storage.ErrAPIKeyNotFound)
+	require.ErrorIs(t, s.RevokeAPIKey(ctx, 42), storage.ErrAPIKeyNotFound)
+
+	id, err := s.CreateAPIKey(ctx, "batch-job", []byte("hash"), []string{"segments:read"})
+	require.NoError(t, err)
+	require.NoError(t, s.RevokeAPIKey(ctx, id))
+
+	require.ErrorIs(t, s.RevokeAPIKey(ctx, id), storage.ErrAPIKeyNotFound)
+	require.ErrorIs(t, s.RotateAPIKey(ctx, id, []byte("new-hash")), storage.ErrAPIKeyNotFound)
+}
+
+func testConcurrentCreateSegment(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	const workers = 10
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+		exists  int
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := s.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, storage.ErrSegmentExists):
+				exists++
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Equal(t, 1, created)
+	require.Equal(t, workers-1, exists)
+}
+
+func testConcurrentMemberships(t *testing.T, s storage.Store) {
+	ctx := context.Background()
+
+	const workers = 10
+
+	segments := make([]string, workers)
+	for i := range segments {
+		segments[i] = fmt.Sprintf("AVITO_SEGMENT_%02d", i)
+	}
+	mustCreateSegments(t, s, segments...)
+	require.NoError(t, s.CreateUser(ctx, 1000, segments[:1]))
+
+	var wg sync.WaitGroup
+	for _, segment := range segments[1:] {
+		segment := segment
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := s.AddUserToSegment(ctx, 1000, []string{segment}, nil); err != nil {
+				t.Errorf("add %s: %v", segment, err)
+			}
+			if err := s.RemoveSegmentsFromUser(ctx, 1000, []string{segment}); err != nil {
+				t.Errorf("remove %s: %v", segment, err)
+			}
+			if err := s.AddUserToSegment(ctx, 1000, []string{segment}, nil); err != nil {
+				t.Errorf("add %s: %v", segment, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	active, err := s.ShowActiveSegmentUser(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, segments, active)
+}
+
+func mustCreateSegments(t *testing.T, s storage.Store, segments ...string) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	for _, segment := range segments {
+		_, err := s.CreateSegment(ctx, segment, 0, storage.SegmentMeta{})
+		require.NoError(t, err)
+	}
+}
+
+func requireActiveSegments(t *testing.T, s storage.Store, user_id int64, segments ...string) {
+	t.Helper()
+
+	active, err := s.ShowActiveSegmentUser(context.Background(), user_id)
+	require.NoError(t, err)
+	require.Equal(t, segments, active)
+}
+
+func aliasNames(aliases []storage.SegmentAlias) []string {
+	names := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		names = append(names, alias.Name)
+	}
+	return names
+}
+
+func names(segments []storage.Segment) []string {
+	names := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		names = append(names, segment.Name)
+	}
+	return names
+}
+
+// collectHistory collects the membership changes made in [from, to).
+func collectHistory(ctx context.Context, s storage.Store, from, to time.Time) ([]storage.HistoryRecord, error) {
+	var records []storage.HistoryRecord
+	err := s.History(ctx, from, to, func(record storage.HistoryRecord) error {
+		records = append(records, record)
+		return nil
+	})
+
+	return records, err
+}
+
+func operations(records []storage.HistoryRecord) []string {
+	ops := make([]string, 0, len(records))
+	for _, record := range records {
+		ops = append(ops, fmt.Sprintf("%d %s %s", record.UserID, record.Segment, record.Operation))
+	}
+
+	return ops
+}
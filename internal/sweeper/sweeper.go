@@ -0,0 +1,54 @@
+package sweeper
+
+import (
+	"avito-internship/internal/lib/logger/slogger"
+	"context"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+type Store interface {
+	RemoveExpiredSegments(ctx context.Context, now time.Time) (int64, error)
+	PurgeSegments(ctx context.Context, deletedBefore time.Time) (int64, error)
+}
+
+// Run periodically removes expired user memberships and purges segments
+// deleted more than retention ago until ctx is done.
+func Run(ctx context.Context, log *slog.Logger, store Store, interval, retention time.Duration) {
+	const op = "sweeper.Run"
+
+	log = log.With(
+		slog.String("op", op),
+	)
+
+	log.Info("sweeper started", slog.String("interval", interval.String()))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("sweeper stopped")
+
+			return
+		case <-ticker.C:
+			now := time.Now()
+
+			removed, err := store.RemoveExpiredSegments(ctx, now)
+			if err != nil {
+				log.Error("failed to remove expired segments", slogger.Err(err))
+			} else if removed > 0 {
+				log.Info("expired segments removed", slog.Int64("removed", removed))
+			}
+
+			purged, err := store.PurgeSegments(ctx, now.Add(-retention))
+			if err != nil {
+				log.Error("failed to purge deleted segments", slogger.Err(err))
+			} else if purged > 0 {
+				log.Info("deleted segments purged", slog.Int64("purged", purged))
+			}
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Package userimport creates users in bulk from CSV or NDJSON files.
+package userimport
+
+import (
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/lib/lines"
+	"avito-internship/internal/storage"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Formats of the input.
+const (
+	// FormatCSV has a user id followed by its segments on every line. A
+	// first line whose user id is not a number is a header.
+	FormatCSV = "csv"
+	// FormatNDJSON has a JSON object like the POST /users request on every
+	// line.
+	FormatNDJSON = "ndjson"
+)
+
+// Counters of import jobs.
+const (
+	CounterProcessed = "processed"
+	CounterImported  = "imported"
+	CounterFailed    = "failed"
+)
+
+// maxLineSize bounds a single line of NDJSON input.
+const maxLineSize = 1 << 20
+
+var errUserIDRequired = errors.New("userId is required")
+
+type Store interface {
+	ImportUsers(ctx context.Context, users []storage.ImportedUser, dryRun bool) (map[int]error, error)
+}
+
+// row is a user read from the input.
+type row struct {
+	line int
+	user storage.ImportedUser
+}
+
+// rowError is an invalid row, the input is read on after it.
+type rowError struct {
+	line int
+	err  error
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.line, e.err)
+}
+
+type reader interface {
+	// read returns the next row, a *rowError if the row is invalid or
+	// io.EOF at the end of the input.
+	read() (row, error)
+}
+
+// Import reads users in format from r and creates them with store in
+// batches of batchSize, each in its own transaction. Rows which cannot be
+// created are reported to progress, the others are still created. With
+// dryRun the rows are only checked; users repeated in different batches
+// are then not detected.
+//
+// It stops on the first read or storage error, batches created before
+// are kept.
+func Import(ctx context.Context, store Store, r io.Reader, format string, batchSize int, dryRun bool, progress *jobs.Progress) error {
+	const op = "userimport.Import"
+
+	var rd reader
+	switch format {
+	case FormatCSV:
+		rd = newCSVReader(r)
+	case FormatNDJSON:
+		rd = newNDJSONReader(r)
+	default:
+		return fmt.Errorf("%s: unknown format %q", op, format)
+	}
+
+	batch := make([]row, 0, batchSize)
+
+	for {
+		next, err := rd.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		var rowErr *rowError
+		if errors.As(err, &rowErr) {
+			progress.Add(CounterProcessed, 1)
+			progress.Add(CounterFailed, 1)
+			progress.Fail(rowErr.line, rowErr.err)
+
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: failed to read input: %w", op, err)
+		}
+
+		batch = append(batch, next)
+		if len(batch) < batchSize {
+			continue
+		}
+
+		if err := importBatch(ctx, store, batch, dryRun, progress); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		batch = batch[:0]
+	}
+
+	if err := importBatch(ctx, store, batch, dryRun, progress); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+func importBatch(ctx context.Context, store Store, batch []row, dryRun bool, progress *jobs.Progress) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	users := make([]storage.ImportedUser, 0, len(batch))
+	for _, row := range batch {
+		users = append(users, row.user)
+	}
+
+	failed, err := store.ImportUsers(ctx, users, dryRun)
+	if err != nil {
+		return err
+	}
+
+	for i, row := range batch {
+		if err, ok := failed[i]; ok {
+			progress.Fail(row.line, err)
+		}
+	}
+
+	progress.Add(CounterProcessed, int64(len(batch)))
+	progress.Add(CounterImported, int64(len(batch)-len(failed)))
+	progress.Add(CounterFailed, int64(len(failed)))
+
+	return nil
+}
+
+type csvReader struct {
+	r     *csv.Reader
+	first bool
+}
+
+func newCSVReader(r io.Reader) *csvReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	return &csvReader{r: cr, first: true}
+}
+
+func (c *csvReader) read() (row, error) {
+	for {
+		record, err := c.r.Read()
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			c.first = false
+			return row{}, &rowError{line: parseErr.Line, err: parseErr.Err}
+		}
+		if err != nil {
+			return row{}, err
+		}
+
+		line, _ := c.r.FieldPos(0)
+
+		first := c.first
+		c.first = false
+
+		id, err := strconv.ParseInt(strings.TrimSpace(record[0]), 10, 64)
+		if err != nil && first {
+			continue
+		}
+		if err != nil {
+			return row{}, &rowError{line: line, err: fmt.Errorf("invalid user id %q", record[0])}
+		}
+		if id == 0 {
+			return row{}, &rowError{line: line, err: errUserIDRequired}
+		}
+
+		var segments []string
+		for _, field := range record[1:] {
+			if field = strings.TrimSpace(field); field != "" {
+				segments = append(segments, field)
+			}
+		}
+
+		return row{line: line, user: storage.ImportedUser{UserID: id, Segments: segments}}, nil
+	}
+}
+
+type ndjsonReader struct {
+	r    *lines.Reader
+	line int
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	return &ndjsonReader{r: lines.NewReader(r, maxLineSize)}
+}
+
+func (n *ndjsonReader) read() (row, error) {
+	for {
+		b, tooLong, err := n.r.Read()
+		if err != nil {
+			return row{}, err
+		}
+		n.line++
+
+		if tooLong {
+			return row{}, &rowError{line: n.line, err: fmt.Errorf("line is longer than %d bytes", maxLineSize)}
+		}
+
+		b = bytes.TrimSpace(b)
+		if len(b) == 0 {
+			continue
+		}
+
+		var user struct {
+			UserID   int64    `json:"userId"`
+			Segments []string `json:"segments"`
+		}
+		if err := json.Unmarshal(b, &user); err != nil {
+			return row{}, &rowError{line: n.line, err: fmt.Errorf("invalid JSON: %w", err)}
+		}
+		if user.UserID == 0 {
+			return row{}, &rowError{line: n.line, err: errUserIDRequired}
+		}
+
+		return row{line: n.line, user: storage.ImportedUser{UserID: user.UserID, Segments: user.Segments}}, nil
+	}
+}
@@ -0,0 +1,115 @@
+package userimport
+
+import (
+	"avito-internship/internal/lib/jobs"
+	"avito-internship/internal/storage"
+	"avito-internship/internal/storage/memory"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func runImport(t *testing.T, store Store, input, format string, dryRun bool) jobs.Job {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	queue := jobs.NewQueue(1, time.Hour)
+	go queue.Run(ctx, slog.New(slog.NewTextHandler(io.Discard, nil)), 1)
+
+	job, err := queue.Submit("users_import", dryRun, func(ctx context.Context, progress *jobs.Progress) error {
+		return Import(ctx, store, strings.NewReader(input), format, 2, dryRun, progress)
+	})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		job, err = queue.Get(job.ID)
+		require.NoError(t, err)
+		return job.Finished()
+	}, time.Second, 10*time.Millisecond)
+
+	return job
+}
+
+func TestImportCSV(t *testing.T) {
+	store := memory.New()
+	_, err := store.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	input := "user_id,segments\n" +
+		"1000,AVITO_VOICE_MESSAGES\n" +
+		"abc\n" +
+		"1001, AVITO_DISCOUNT_30\n" +
+		"1002\n" +
+		"1000\n"
+
+	job := runImport(t, store, input, FormatCSV, true)
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{CounterProcessed: 5, CounterImported: 3, CounterFailed: 2}, job.Counters)
+
+	exists, err := store.UserExists(context.Background(), 1000)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	job = runImport(t, store, input, FormatCSV, false)
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{CounterProcessed: 5, CounterImported: 2, CounterFailed: 3}, job.Counters)
+
+	lines := make([]int, 0, len(job.Errors))
+	for _, e := range job.Errors {
+		lines = append(lines, e.Line)
+	}
+	require.Equal(t, []int{3, 4, 6}, lines)
+
+	segments, err := store.ShowActiveSegmentUser(context.Background(), 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+}
+
+func TestImportNDJSON(t *testing.T) {
+	store := memory.New()
+	_, err := store.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", 0, storage.SegmentMeta{})
+	require.NoError(t, err)
+
+	input := `{"userId":1000,"segments":["AVITO_VOICE_MESSAGES"]}` + "\n" +
+		"\n" +
+		`{"userId":1001}` + "\n" +
+		`{"segments":["AVITO_VOICE_MESSAGES"]}` + "\n" +
+		`{"userId":` + "\n"
+
+	job := runImport(t, store, input, FormatNDJSON, false)
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{CounterProcessed: 4, CounterImported: 2, CounterFailed: 2}, job.Counters)
+	require.Len(t, job.Errors, 2)
+	require.Equal(t, 4, job.Errors[0].Line)
+	require.Equal(t, 5, job.Errors[1].Line)
+
+	exists, err := store.UserExists(context.Background(), 1001)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestImportNDJSONLongLine(t *testing.T) {
+	store := memory.New()
+
+	// The long line is reported and the lines after it are still imported.
+	input := `{"userId":1000}` + "\n" +
+		`{"userId":1001,"segments":["` + strings.Repeat("A", maxLineSize) + `"]}` + "\n" +
+		`{"userId":1002}`
+
+	job := runImport(t, store, input, FormatNDJSON, false)
+	require.Equal(t, jobs.StatusSucceeded, job.Status)
+	require.Equal(t, map[string]int64{CounterProcessed: 3, CounterImported: 2, CounterFailed: 1}, job.Counters)
+	require.Len(t, job.Errors, 1)
+	require.Equal(t, 2, job.Errors[0].Line)
+
+	exists, err := store.UserExists(context.Background(), 1002)
+	require.NoError(t, err)
+	require.True(t, exists)
+}
@@ -0,0 +1,313 @@
+// Package client is a typed Go client of the segment service API.
+package client
+
+import (
+	"avito-internship/internal/http-server/handlers/segments/del"
+	"avito-internship/internal/http-server/handlers/segments/save"
+	getactiveseg "avito-internship/internal/http-server/handlers/users/get-active-seg"
+	"avito-internship/internal/http-server/handlers/users/save/saveuser"
+	updatesegments "avito-internship/internal/http-server/handlers/users/update_segments"
+	resp "avito-internship/internal/lib/api/response"
+	"avito-internship/internal/storage"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Request and response types shared with the service handlers.
+type (
+	CreateSegmentRequest       = save.Request
+	CreateSegmentResponse      = save.Response
+	DeleteSegmentResponse      = del.Response
+	CreateUserRequest          = saveuser.Request
+	UserSegmentsResponse       = getactiveseg.Response
+	UpdateUserSegmentsRequest  = updatesegments.Request
+	UpdateUserSegmentsResponse = updatesegments.Response
+	Problem                    = resp.Problem
+)
+
+// Errors returned by the service, matched with errors.Is.
+var (
+	ErrSegmentExists   = storage.ErrSegmentExists
+	ErrSegmentNotFound = storage.ErrSegmentNotFound
+	ErrSegmentConflict = storage.ErrSegmentConflict
+	ErrUserExists      = storage.ErrUserExists
+	ErrUserNotFound    = storage.ErrUserNotFound
+	ErrTimeout         = storage.ErrTimeout
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrRateLimited     = errors.New("rate limited")
+)
+
+var codeErrors = map[string]error{
+	resp.CodeSegmentExists:   ErrSegmentExists,
+	resp.CodeSegmentNotFound: ErrSegmentNotFound,
+	resp.CodeSegmentConflict: ErrSegmentConflict,
+	resp.CodeUserExists:      ErrUserExists,
+	resp.CodeUserNotFound:    ErrUserNotFound,
+	resp.CodeTimeout:         ErrTimeout,
+	resp.CodeUnauthorized:    ErrUnauthorized,
+	resp.CodeForbidden:       ErrForbidden,
+	resp.CodeRateLimited:     ErrRateLimited,
+}
+
+// APIError is returned when the service replies with an error status.
+type APIError struct {
+	StatusCode int
+	Problem    Problem
+}
+
+func (e *APIError) Error() string {
+	if e.Problem.Detail != "" {
+		return fmt.Sprintf("segment service: %d %s: %s", e.StatusCode, e.Problem.Code, e.Problem.Detail)
+	}
+	return fmt.Sprintf("segment service: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Unwrap maps the problem code to one of the package errors.
+func (e *APIError) Unwrap() error {
+	return codeErrors[e.Problem.Code]
+}
+
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	maxRetries int
+	backoff    time.Duration
+	apiKey     string
+	token      string
+}
+
+type Option func(c *Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithRetries sets how many times requests failed with 5xx or a transport
+// error are retried. The delay before retry n is backoff * 2^(n-1).
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.backoff = backoff
+	}
+}
+
+// WithAPIKey sets the API key sent in the X-API-Key header.
+func WithAPIKey(key string) Option {
+	return func(c *Client) {
+		c.apiKey = key
+	}
+}
+
+// WithBearerToken sets the user JWT sent in the Authorization header.
+func WithBearerToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New returns a client of the service at baseURL, e.g. http://localhost:8080.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    100 * time.Millisecond,
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// CreateSegment creates a segment, optionally enrolling autoPercent percent of users into it.
+func (c *Client) CreateSegment(ctx context.Context, name string, autoPercent int) error {
+	req := CreateSegmentRequest{SegmentName: name, AutoPercent: autoPercent}
+
+	return c.do(ctx, http.MethodPost, "/segment", req, &CreateSegmentResponse{})
+}
+
+// DeleteSegment deletes a segment and returns its id.
+func (c *Client) DeleteSegment(ctx context.Context, name string) (int64, error) {
+	req := del.Request{SegmentName: name}
+
+	var res DeleteSegmentResponse
+	if err := c.do(ctx, http.MethodDelete, "/segment/"+url.PathEscape(name), req, &res); err != nil {
+		return 0, err
+	}
+
+	return res.SegmentID, nil
+}
+
+// CreateUser creates a user with the given segments.
+func (c *Client) CreateUser(ctx context.Context, userID int64, segments []string) error {
+	req := CreateUserRequest{UserId: userID, Segments: segments}
+
+	return c.do(ctx, http.MethodPost, "/users", req, &saveuser.Response{})
+}
+
+// UpdateUserSegments atomically adds and removes user segments and returns
+// the resulting segments of the user.
+func (c *Client) UpdateUserSegments(ctx context.Context, userID int64, add, remove []string) ([]string, error) {
+	req := UpdateUserSegmentsRequest{Add: add, Remove: remove}
+
+	var res UpdateUserSegmentsResponse
+	if err := c.do(ctx, http.MethodPatch, userSegmentsPath(userID), req, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Segments, nil
+}
+
+// GetUserSegments returns active segments of the user.
+func (c *Client) GetUserSegments(ctx context.Context, userID int64) ([]string, error) {
+	var res UserSegmentsResponse
+	if err := c.do(ctx, http.MethodGet, userSegmentsPath(userID), nil, &res); err != nil {
+		return nil, err
+	}
+
+	return res.Segments, nil
+}
+
+func userSegmentsPath(userID int64) string {
+	return "/users/" + strconv.FormatInt(userID, 10) + "/segments"
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("segment service: failed to encode request: %w", err)
+		}
+	}
+
+	// Retries of a mutating request carry the same idempotency key, so the
+	// service applies the request once.
+	var idempotencyKey string
+	if method != http.MethodGet {
+		var err error
+		idempotencyKey, err = newIdempotencyKey()
+		if err != nil {
+			return fmt.Errorf("segment service: %w", err)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.doOnce(ctx, method, path, payload, idempotencyKey, out)
+		if err == nil || attempt >= c.maxRetries || !retryable(err) {
+			return err
+		}
+
+		delay := c.backoff << attempt
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (c *Client) doOnce(ctx context.Context, method, path string, payload []byte, idempotencyKey string, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("segment service: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	// Continue the caller's trace, if any, in the service.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return &transportError{err: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		apiErr := &APIError{StatusCode: res.StatusCode}
+		// The body may be missing or not a problem, e.g. from a proxy.
+		json.NewDecoder(res.Body).Decode(&apiErr.Problem)
+		return apiErr
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("segment service: failed to decode response: %w", err)
+	}
+
+	return nil
+}
+
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string {
+	return "segment service: " + e.err.Error()
+}
+
+func (e *transportError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		// The previous attempt is still being processed by the service.
+		if apiErr.Problem.Code == resp.CodeIdempotencyInProgress {
+			return true
+		}
+		return apiErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var transportErr *transportError
+	if errors.As(err, &transportErr) {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+
+	return false
+}
+
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,156 @@
+package client_test
+
+import (
+	"avito-internship/internal/http-server/handlers/segments/del"
+	"avito-internship/internal/http-server/handlers/segments/save"
+	getactiveseg "avito-internship/internal/http-server/handlers/users/get-active-seg"
+	"avito-internship/internal/http-server/handlers/users/save/saveuser"
+	updatesegments "avito-internship/internal/http-server/handlers/users/update_segments"
+	"avito-internship/internal/storage/memory"
+	"avito-internship/pkg/client"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := memory.New()
+
+	router := chi.NewRouter()
+	router.Post("/segment", save.New(log, store))
+	router.Delete("/segment/{id}", del.DelSeg(log, store))
+	router.Post("/users", saveuser.New(log, store))
+	router.Get("/users/{id}/segments", getactiveseg.GetActiveSegmentsForUser(log, store))
+	router.Patch("/users/{id}/segments", updatesegments.Update(log, store))
+
+	srv := httptest.NewServer(router)
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := client.New(newServer(t).URL)
+
+	require.NoError(t, c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0))
+	require.NoError(t, c.CreateSegment(ctx, "AVITO_DISCOUNT_30", 0))
+
+	err := c.CreateSegment(ctx, "AVITO_VOICE_MESSAGES", 0)
+	require.ErrorIs(t, err, client.ErrSegmentExists)
+
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	require.Equal(t, http.StatusConflict, apiErr.StatusCode)
+
+	require.NoError(t, c.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}))
+	require.ErrorIs(t, c.CreateUser(ctx, 1000, []string{"AVITO_VOICE_MESSAGES"}), client.ErrUserExists)
+
+	segments, err := c.UpdateUserSegments(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, []string{"AVITO_VOICE_MESSAGES"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30"}, segments)
+
+	_, err = c.UpdateUserSegments(ctx, 1000, []string{"AVITO_DISCOUNT_30"}, []string{"AVITO_DISCOUNT_30"})
+	require.ErrorIs(t, err, client.ErrSegmentConflict)
+
+	segments, err = c.GetUserSegments(ctx, 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_DISCOUNT_30"}, segments)
+
+	_, err = c.GetUserSegments(ctx, 2000)
+	require.ErrorIs(t, err, client.ErrUserNotFound)
+
+	_, err = c.DeleteSegment(ctx, "AVITO_DISCOUNT_30")
+	require.NoError(t, err)
+
+	_, err = c.DeleteSegment(ctx, "AVITO_DISCOUNT_30")
+	require.ErrorIs(t, err, client.ErrSegmentNotFound)
+
+	segments, err = c.GetUserSegments(ctx, 1000)
+	require.NoError(t, err)
+	require.Empty(t, segments)
+}
+
+func TestClientRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"OK","segments":["AVITO_VOICE_MESSAGES"]}`))
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(3, time.Millisecond))
+
+	segments, err := c.GetUserSegments(context.Background(), 1000)
+	require.NoError(t, err)
+	require.Equal(t, []string{"AVITO_VOICE_MESSAGES"}, segments)
+	require.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestClientGivesUp(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(2, time.Millisecond))
+
+	_, err := c.GetUserSegments(context.Background(), 1000)
+
+	var apiErr *client.APIError
+	require.True(t, errors.As(err, &apiErr))
+	require.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	require.EqualValues(t, 3, atomic.LoadInt32(&calls))
+}
+
+func TestClientDoesNotRetryClientErrors(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"status":404,"code":"user_not_found"}`))
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(3, time.Millisecond))
+
+	_, err := c.GetUserSegments(context.Background(), 1000)
+	require.ErrorIs(t, err, client.ErrUserNotFound)
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+}
+
+func TestClientReusesIdempotencyKey(t *testing.T) {
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) < 2 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"OK"}`))
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(3, time.Millisecond))
+
+	require.NoError(t, c.CreateSegment(context.Background(), "AVITO_VOICE_MESSAGES", 0))
+	require.Len(t, keys, 2)
+	require.NotEmpty(t, keys[0])
+	require.Equal(t, keys[0], keys[1])
+}